@@ -0,0 +1,84 @@
+package filecache
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// 每个block在header中有一个8K的bloom filter，记录这个block中写入过的key
+// del不会清除bloom中的bit，Compact的时候重建
+const bloomOffset = journalOffset + journalSize
+const bloomSize = 8192
+const bloomBits = bloomSize * 8
+const bloomHashCount = 5
+
+func (r *CacheImpl) bloomBitsOf(key string) [bloomHashCount]uint32 {
+	h := keyHash(key)
+	h1, h2 := uint32(h), uint32(h>>32)
+
+	var bits [bloomHashCount]uint32
+	for i := range bits {
+		bits[i] = (h1 + uint32(i)*h2) % bloomBits
+	}
+	return bits
+}
+
+func (r *CacheImpl) bloomAdd(block int, key string) {
+	filter := r.mmap[bloomOffset+block*bloomSize : bloomOffset+(block+1)*bloomSize]
+	for _, bit := range r.bloomBitsOf(key) {
+		filter[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// 需要持有r.mu，扩容的时候mmap会重新映射
+func (r *CacheImpl) bloomGen() *uint64 {
+	return (*uint64)(unsafe.Pointer(&r.mmap[metaBloomGen]))
+}
+
+// 第二个返回值是是否查了filter，filter不完整或者查的过程中其他进程开始了重建时返回true, false
+func (r *CacheImpl) bloomMayContain(block int, key string) (bool, bool) {
+	gen := atomic.LoadUint64(r.bloomGen())
+	if gen%2 == 1 || r.headerUint32(metaFlags)&flagBloom == 0 {
+		return true, false
+	}
+
+	filter := r.mmap[bloomOffset+block*bloomSize : bloomOffset+(block+1)*bloomSize]
+	may := true
+	for _, bit := range r.bloomBitsOf(key) {
+		if filter[bit/8]&(1<<(bit%8)) == 0 {
+			may = false
+			break
+		}
+	}
+	// 和seqlock一样，读的过程中gen变了的话结果不可信
+	if atomic.LoadUint64(r.bloomGen()) != gen {
+		return true, false
+	}
+
+	atomic.AddUint64(&r.stats.bloomChecks, 1)
+	if !may {
+		atomic.AddUint64(&r.stats.bloomNegatives, 1)
+	}
+	return may, true
+}
+
+// 重建的过程中其他进程还在读，gen为奇数时它们不会用filter判断key不存在
+func (r *CacheImpl) rebuildBloom() error {
+	atomic.AddUint64(r.bloomGen(), 1)
+	defer atomic.AddUint64(r.bloomGen(), 1)
+
+	r.putHeaderUint32(metaFlags, r.headerUint32(metaFlags)&^flagBloom)
+	for i := bloomOffset; i < bloomOffset+bufCount*bloomSize; i++ {
+		r.mmap[i] = 0
+	}
+	err := r.scan(func(kv *kv) error {
+		r.bloomAdd((kv.offset-headerSize)/bufSize, kv.rawKey)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	r.putHeaderUint32(metaFlags, r.headerUint32(metaFlags)|flagBloom)
+	return nil
+}
@@ -0,0 +1,120 @@
+package filecache_test
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Chyroc/filecache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBloom(t *testing.T) {
+	as := assert.New(t)
+	defer os.Remove("./test-bloom")
+
+	os.Remove("./test-bloom")
+	c, err := filecache.Open("./test-bloom")
+	as.Nil(err)
+
+	for i := 0; i < 10000; i++ {
+		j := strconv.Itoa(i)
+		as.Nil(c.Set(j, j, time.Minute))
+	}
+
+	t.Run("miss", func(t *testing.T) {
+		for i := 0; i < 1000; i++ {
+			_, err := c.Get("miss-" + strconv.Itoa(i))
+			as.Equal(filecache.NotFound, err)
+		}
+
+		stats := c.Stats()
+		as.True(stats.BloomNegatives > 0)
+		as.True(stats.BloomFalsePositiveRate() < 0.05)
+	})
+
+	t.Run("hit", func(t *testing.T) {
+		for i := 0; i < 10000; i++ {
+			j := strconv.Itoa(i)
+			v, err := c.Get(j)
+			as.Nil(err)
+			as.Equal(j, v)
+		}
+	})
+
+	t.Run("compact", func(t *testing.T) {
+		for i := 0; i < 9000; i++ {
+			as.Nil(c.Del(strconv.Itoa(i)))
+		}
+		as.Nil(c.Set("expired", "v", time.Millisecond))
+		time.Sleep(time.Millisecond * 2)
+
+		as.Nil(c.Compact())
+
+		kvs, err := c.Range()
+		as.Nil(err)
+		as.Len(kvs, 1000)
+		for i := 9000; i < 10000; i++ {
+			j := strconv.Itoa(i)
+			v, err := c.Get(j)
+			as.Nil(err)
+			as.Equal(j, v)
+		}
+
+		report, err := filecache.Check("./test-bloom")
+		as.Nil(err)
+		as.True(report.OK())
+		as.Equal(1000, report.Docs)
+	})
+
+	t.Run("compact while reading", func(t *testing.T) {
+		for round := 0; round < 5; round++ {
+			// 前面的key占满block 0，删掉之后Compact把后面block中的key移过来
+			prefix := fmt.Sprintf("r%d-", round)
+			for i := 0; i < 10000; i++ {
+				j := prefix + strconv.Itoa(i)
+				as.Nil(c.Set(j, j, time.Minute))
+			}
+			for i := 0; i < 9000; i++ {
+				as.Nil(c.Del(prefix + strconv.Itoa(i)))
+			}
+
+			// 其他进程在移动doc、重建bloom filter的过程中读，不会误判key不存在
+			other, err := filecache.Open("./test-bloom")
+			as.Nil(err)
+			stop, done := make(chan struct{}), make(chan struct{})
+			misses := 0
+			go func() {
+				defer close(done)
+				for n := 0; ; n++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					if _, err := other.Get(prefix + strconv.Itoa(9000+n%1000)); err != nil {
+						misses++
+					}
+				}
+			}()
+			as.Nil(c.Compact())
+			close(stop)
+			<-done
+			as.Equal(0, misses)
+			as.Nil(other.Close())
+			for i := 9000; i < 10000; i++ {
+				as.Nil(c.Del(prefix + strconv.Itoa(i)))
+			}
+		}
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		c, err := filecache.Open("./test-bloom")
+		as.Nil(err)
+		v, err := c.Get("9999")
+		as.Nil(err)
+		as.Equal("9999", v)
+	})
+}
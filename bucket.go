@@ -0,0 +1,418 @@
+package filecache
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var InvalidBucketName = errors.New("invalid bucket name")
+var TooManyBuckets = errors.New("too many buckets")
+var QuotaExceeded = errors.New("bucket quota exceeded")
+
+// header中的bucket表，下标是bucket的id，0是默认的bucket（直接通过CacheImpl读写的数据），只用来记录用量
+// 每一项是 name_len(1), name(63), max_keys(8), max_bytes(8), keys(8), bytes(8)
+// keys和bytes是文件中这个bucket的doc的数量和长度，包括已经过期、还没有被清理的
+const bucketOffset = loadLockOffset + loadLockSlots*8
+const bucketEntrySize = 96
+const maxBuckets = 256
+const maxLengthBucketName = 63
+
+const (
+	bucketMaxKeys  = 64
+	bucketMaxBytes = 72
+	bucketKeys     = 80
+	bucketBytes    = 88
+)
+
+func bucketEntry(ns int) int {
+	return bucketOffset + ns*bucketEntrySize
+}
+
+// 区分不同bucket中相同的key，用于索引和去重
+func nsKey(ns int, key string) string {
+	return string([]byte{byte(ns)}) + key
+}
+
+func checkBucketName(name string) error {
+	if len(name) == 0 || len(name) > maxLengthBucketName {
+		return InvalidBucketName
+	}
+	return nil
+}
+
+type BucketOption func(*bucketQuota)
+
+type bucketQuota struct {
+	maxKeys  uint64
+	maxBytes uint64
+}
+
+// WithBucketQuota 限制bucket中doc的数量和总长度，0表示不限制，都是0时去掉限制
+// 超过之后会先清理这个bucket中过期的数据，还是超过的话Set返回QuotaExceeded
+func WithBucketQuota(maxKeys int, maxBytes int64) BucketOption {
+	return func(q *bucketQuota) {
+		q.maxKeys = uint64(maxKeys)
+		q.maxBytes = uint64(maxBytes)
+	}
+}
+
+// opBucket的val: max_keys(uvarint), max_bytes(uvarint)
+func (q *bucketQuota) encode() string {
+	buf := make([]byte, 2*binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, q.maxKeys)
+	n += binary.PutUvarint(buf[n:], q.maxBytes)
+	return string(buf[:n])
+}
+
+func decodeBucketQuota(val string) (*bucketQuota, error) {
+	buf := []byte(val)
+	maxKeys, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, InvalidFileFormat
+	}
+	maxBytes, m := binary.Uvarint(buf[n:])
+	if m <= 0 {
+		return nil, InvalidFileFormat
+	}
+	return &bucketQuota{maxKeys: maxKeys, maxBytes: maxBytes}, nil
+}
+
+// Bucket 是文件中一个独立的keyspace，不同bucket中相同的key互不影响
+// bucket的id记录在doc的扩展头里，不占用key的长度，一个文件中最多有255个bucket
+type Bucket struct {
+	cache *CacheImpl
+	name  string
+	ns    int
+}
+
+type BucketStats struct {
+	Keys     int64 // 包括已经过期、还没有被清理的
+	Bytes    int64 // doc的总长度，包括doc头和扩展头
+	MaxKeys  int64
+	MaxBytes int64
+}
+
+// Bucket 返回名字是name的bucket，不存在的话创建，名字最长63个字节
+// 传了opts的时候更新bucket的quota
+func (r *CacheImpl) Bucket(name string, opts ...BucketOption) (*Bucket, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return nil, r.err
+	} else if err := checkBucketName(name); err != nil {
+		return nil, err
+	}
+
+	ns, free := 0, 0
+	for i := 1; i < maxBuckets; i++ {
+		if n := r.bucketName(i); n == name {
+			ns = i
+			break
+		} else if n == "" && free == 0 {
+			free = i
+		}
+	}
+	if ns > 0 && len(opts) == 0 {
+		return &Bucket{cache: r, name: name, ns: ns}, nil
+	} else if ns == 0 && free == 0 {
+		return nil, TooManyBuckets
+	} else if ns == 0 {
+		ns = free
+	}
+
+	var q bucketQuota
+	for _, opt := range opts {
+		opt(&q)
+	}
+	if err := r.mutate([]*op{{kind: opBucket, key: name, val: q.encode(), ns: byte(ns)}}); err != nil {
+		return nil, err
+	}
+	return &Bucket{cache: r, name: name, ns: ns}, nil
+}
+
+func (r *CacheImpl) bucketName(ns int) string {
+	entry := bucketEntry(ns)
+	n := int(r.mmap[entry])
+	if n > maxLengthBucketName {
+		return ""
+	}
+	return string(r.mmap[entry+1 : entry+1+n])
+}
+
+func (r *CacheImpl) putBucket(o *op) error {
+	ns := int(o.ns)
+	if ns <= 0 || ns >= maxBuckets {
+		return InvalidFileFormat
+	} else if name := r.bucketName(ns); name != "" && name != o.key {
+		return InvalidFileFormat
+	}
+	q, err := decodeBucketQuota(o.val)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, bucketKeys)
+	buf[0] = byte(len(o.key))
+	copy(buf[1:], o.key)
+	binary.LittleEndian.PutUint64(buf[bucketMaxKeys:], q.maxKeys)
+	binary.LittleEndian.PutUint64(buf[bucketMaxBytes:], q.maxBytes)
+	return r.write(bucketEntry(ns), buf)
+}
+
+// 已经注册的bucket
+func (r *CacheImpl) buckets() []*op {
+	var ops []*op
+	for ns := 1; ns < maxBuckets; ns++ {
+		if name := r.bucketName(ns); name != "" {
+			entry := bucketEntry(ns)
+			q := &bucketQuota{maxKeys: r.headerUint64(entry + bucketMaxKeys), maxBytes: r.headerUint64(entry + bucketMaxBytes)}
+			ops = append(ops, &op{kind: opBucket, key: name, val: q.encode(), ns: byte(ns)})
+		}
+	}
+	return ops
+}
+
+// doc的扩展头和doc的长度
+func (r *CacheImpl) docExtHeader(offset int) (extHeader, int, error) {
+	var ext extHeader
+	keyLen, err := binaryInt(r.mmap[offset+1 : offset+3])
+	if err != nil {
+		return ext, 0, err
+	}
+	valLen, err := binaryInt(r.mmap[offset+3 : offset+5])
+	if err != nil {
+		return ext, 0, err
+	}
+	valOffset := offset + docHeaderLength + keyLen
+	ext, _, err = splitExt(r.mmap[offset], r.mmap[valOffset:valOffset+valLen])
+	if err != nil {
+		return ext, 0, err
+	}
+	return ext, docHeaderLength + keyLen + valLen, nil
+}
+
+// 写入(sign=1)或者删除(sign=-1)offset处的doc之后更新用量，和数据一起通过write修改
+// FlushAll之前写入的doc已经不算在用量里了
+func (r *CacheImpl) addUsage(offset, sign int) error {
+	ext, size, err := r.docExtHeader(offset)
+	if err != nil {
+		return err
+	} else if ext.epoch != r.epoch() {
+		return nil
+	}
+	entry := bucketEntry(ext.ns)
+	keys := int64(r.headerUint64(entry+bucketKeys)) + int64(sign)
+	bytes := int64(r.headerUint64(entry+bucketBytes)) + int64(sign*size)
+	if keys < 0 || bytes < 0 {
+		// 用量和文件对不上，下次打开的时候重新统计
+		keys, bytes = 0, 0
+		r.putHeaderUint32(metaFlags, r.headerUint32(metaFlags)&^flagUsage)
+	}
+
+	buf := make([]byte, 16)
+	binary.LittleEndian.PutUint64(buf, uint64(keys))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(bytes))
+	return r.write(entry+bucketKeys, buf)
+}
+
+// 根据文件中的doc重新统计每个bucket的用量
+func (r *CacheImpl) rebuildUsage() error {
+	var keys, bytes [maxBuckets]uint64
+	epoch := r.epoch()
+	err := r.walk(func(offset int) error {
+		ext, size, err := r.docExtHeader(offset)
+		if err != nil || ext.epoch != epoch {
+			return err
+		}
+		keys[ext.ns]++
+		bytes[ext.ns] += uint64(size)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for ns := 0; ns < maxBuckets; ns++ {
+		r.putHeaderUint64(bucketEntry(ns)+bucketKeys, keys[ns])
+		r.putHeaderUint64(bucketEntry(ns)+bucketBytes, bytes[ns])
+	}
+	r.putHeaderUint32(metaFlags, r.headerUint32(metaFlags)|flagUsage)
+	return nil
+}
+
+// 写入docLen长度的doc之后超过quota时，先清理这个bucket中过了硬过期时间的数据，还是超过的话返回QuotaExceeded
+func (r *CacheImpl) checkQuota(ns int, key string, docLen int) error {
+	entry := bucketEntry(ns)
+	maxKeys := r.headerUint64(entry + bucketMaxKeys)
+	maxBytes := r.headerUint64(entry + bucketMaxBytes)
+	if ns == 0 || maxKeys == 0 && maxBytes == 0 {
+		return nil
+	}
+
+	for reclaimed := false; ; reclaimed = true {
+		keys, bytes := uint64(1), uint64(docLen)
+		if old, err := r.find(ns, key); err == nil {
+			_, size, err := r.docExtHeader(old.offset)
+			if err != nil {
+				return err
+			}
+			keys, bytes = 0, uint64(docLen-size)
+			if docLen < size {
+				bytes = 0
+			}
+		} else if err != NotFound {
+			return err
+		}
+
+		keys += r.headerUint64(entry + bucketKeys)
+		bytes += r.headerUint64(entry + bucketBytes)
+		if (maxKeys == 0 || keys <= maxKeys) && (maxBytes == 0 || bytes <= maxBytes) {
+			return nil
+		} else if reclaimed {
+			return QuotaExceeded
+		}
+
+		err := r.scan(func(kv *kv) error {
+			if kv.ns != ns || !kv.reclaimable() {
+				return nil
+			}
+			return r.reclaim(kv)
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (b *Bucket) Name() string {
+	return b.name
+}
+
+func (b *Bucket) Get(key string) (string, error) {
+	r := b.cache
+	r.mu.RLock()
+	kv, expired, err := r.getExpired(b.ns, key)
+	r.countGet(err)
+	r.mu.RUnlock()
+
+	if expired {
+		r.lazyExpire(context.Background(), b.ns, key)
+	}
+	if err != nil {
+		return "", err
+	}
+	return kv.val, nil
+}
+
+func (b *Bucket) Set(key, val string, ttl time.Duration) error {
+	r := b.cache
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.mutate([]*op{{kind: opSet, key: key, val: val, expiredAt: unixMs(ttl), ns: byte(b.ns)}})
+}
+
+func (b *Bucket) TTL(key string) (time.Duration, error) {
+	r := b.cache
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	kv, err := r.get(b.ns, key)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(kv.ttl) * time.Millisecond, nil
+}
+
+func (b *Bucket) Expire(key string, ttl time.Duration) error {
+	r := b.cache
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.mutate([]*op{{kind: opExpire, key: key, expiredAt: unixMs(ttl), ns: byte(b.ns)}})
+}
+
+func (b *Bucket) Del(key string) error {
+	r := b.cache
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.mutate([]*op{{kind: opDel, key: key, ns: byte(b.ns)}})
+}
+
+func (b *Bucket) Range() ([]*KV, error) {
+	r := b.cache
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.rangeKV(context.Background(), b.ns)
+}
+
+// Flush 删除bucket中所有的数据，bucket本身和quota保留
+// 开启了wal的时候先checkpoint，回放wal时不会再写回删掉的数据，删除完之前其他进程不能写wal
+func (b *Bucket) Flush() error {
+	evicted, err := b.flush()
+	if err != nil {
+		return err
+	}
+	b.cache.onEvict.notify(evicted)
+	return nil
+}
+
+func (b *Bucket) flush() ([]EvictedEvent, error) {
+	r := b.cache
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	if r.wal != nil {
+		if err := r.wal.lock(); err != nil {
+			return nil, err
+		}
+		defer r.wal.unlock()
+		if err := r.checkpoint(); err != nil {
+			return nil, err
+		}
+	}
+
+	evicted := r.evictedDocs(b.ns)
+	epoch := r.epoch()
+	err := r.walk(func(offset int) error {
+		ext, _, err := r.docExtHeader(offset)
+		if err != nil || ext.ns != b.ns {
+			return err
+		}
+		if ext.epoch == epoch {
+			atomic.AddUint64(&r.stats.evictions, 1)
+		}
+		return r.freeDoc(offset)
+	})
+	r.indexReset()
+	if err != nil {
+		return nil, err
+	}
+	return evicted, r.logChange(EventEvict, b.ns, "")
+}
+
+func (b *Bucket) Stats() (*BucketStats, error) {
+	r := b.cache
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	entry := bucketEntry(b.ns)
+	return &BucketStats{
+		Keys:     int64(r.headerUint64(entry + bucketKeys)),
+		Bytes:    int64(r.headerUint64(entry + bucketBytes)),
+		MaxKeys:  int64(r.headerUint64(entry + bucketMaxKeys)),
+		MaxBytes: int64(r.headerUint64(entry + bucketMaxBytes)),
+	}, nil
+}
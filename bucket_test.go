@@ -0,0 +1,175 @@
+package filecache_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Chyroc/filecache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBucket(t *testing.T) {
+	as := assert.New(t)
+	defer os.Remove("./test-bucket")
+
+	for _, opts := range [][]filecache.Option{nil, {filecache.WithIndex()}, {filecache.WithAllocator(filecache.AllocSlab)}} {
+		os.Remove("./test-bucket")
+		c, err := filecache.Open("./test-bucket", opts...)
+		as.Nil(err)
+
+		b1, err := c.Bucket("b1")
+		as.Nil(err)
+		b2, err := c.Bucket("b2")
+		as.Nil(err)
+		as.Equal("b1", b1.Name())
+
+		t.Run("isolation", func(t *testing.T) {
+			as.Nil(c.Set("k", "root", time.Minute))
+			as.Nil(b1.Set("k", "b1", time.Minute))
+			as.Nil(b1.Set(strings.Repeat("k", filecache.MaxLengthKey), "long", time.Minute))
+
+			v, err := c.Get("k")
+			as.Nil(err)
+			as.Equal("root", v)
+			v, err = b1.Get("k")
+			as.Nil(err)
+			as.Equal("b1", v)
+			_, err = b2.Get("k")
+			as.Equal(filecache.NotFound, err)
+
+			as.Nil(b2.Set("k", "b2", time.Minute))
+			as.Nil(b2.Del("k"))
+			_, err = b2.Get("k")
+			as.Equal(filecache.NotFound, err)
+			v, err = b1.Get("k")
+			as.Nil(err)
+			as.Equal("b1", v)
+
+			as.Nil(b1.Expire("k", time.Hour))
+			ttl, err := b1.TTL("k")
+			as.Nil(err)
+			as.True(ttl > time.Minute)
+			ttl, err = c.TTL("k")
+			as.Nil(err)
+			as.True(ttl <= time.Minute)
+
+			kvs, err := c.Range()
+			as.Nil(err)
+			as.Len(kvs, 1)
+			kvs, err = b1.Range()
+			as.Nil(err)
+			as.Len(kvs, 2)
+		})
+
+		t.Run("stats and flush", func(t *testing.T) {
+			stats, err := b1.Stats()
+			as.Nil(err)
+			as.Equal(int64(2), stats.Keys)
+			as.True(stats.Bytes > int64(filecache.MaxLengthKey))
+
+			// 覆盖不会增加数量
+			as.Nil(b1.Set("k", "b1", time.Minute))
+			stats, err = b1.Stats()
+			as.Nil(err)
+			as.Equal(int64(2), stats.Keys)
+
+			as.Nil(b2.Set("k", "b2", time.Minute))
+			as.Nil(b1.Flush())
+			stats, err = b1.Stats()
+			as.Nil(err)
+			as.Equal(int64(0), stats.Keys)
+			as.Equal(int64(0), stats.Bytes)
+			_, err = b1.Get("k")
+			as.Equal(filecache.NotFound, err)
+
+			v, err := b2.Get("k")
+			as.Nil(err)
+			as.Equal("b2", v)
+			v, err = c.Get("k")
+			as.Nil(err)
+			as.Equal("root", v)
+		})
+
+		t.Run("quota", func(t *testing.T) {
+			q, err := c.Bucket("quota", filecache.WithBucketQuota(2, 0))
+			as.Nil(err)
+			as.Nil(q.Set("a", "v", 20*time.Millisecond))
+			as.Nil(q.Set("b", "v", time.Minute))
+			as.Equal(filecache.QuotaExceeded, q.Set("c", "v", time.Minute))
+
+			// 过期的数据会被清理
+			time.Sleep(50 * time.Millisecond)
+			as.Nil(q.Set("c", "v", time.Minute))
+			as.Nil(q.Set("c", "v2", time.Minute))
+			as.Equal(filecache.QuotaExceeded, q.Set("d", "v", time.Minute))
+
+			// 其他bucket不受影响
+			as.Nil(b1.Set("d", "v", time.Minute))
+
+			q, err = c.Bucket("quota", filecache.WithBucketQuota(0, 0))
+			as.Nil(err)
+			as.Nil(q.Set("d", "v", time.Minute))
+			stats, err := q.Stats()
+			as.Nil(err)
+			as.Equal(int64(3), stats.Keys)
+			as.Equal(int64(0), stats.MaxKeys)
+		})
+
+		t.Run("snapshot", func(t *testing.T) {
+			var buf bytes.Buffer
+			as.Nil(c.Snapshot(&buf, filecache.SnapshotLive))
+			as.Nil(b2.Flush())
+			as.Nil(c.Restore(&buf))
+
+			v, err := b2.Get("k")
+			as.Nil(err)
+			as.Equal("b2", v)
+		})
+
+		as.Nil(c.Close())
+
+		t.Run("reopen", func(t *testing.T) {
+			report, err := filecache.Check("./test-bucket")
+			as.Nil(err)
+			as.True(report.OK(), "%v", report.Problems)
+
+			c, err := filecache.Open("./test-bucket", opts...)
+			as.Nil(err)
+			defer c.Close()
+
+			b2, err := c.Bucket("b2")
+			as.Nil(err)
+			v, err := b2.Get("k")
+			as.Nil(err)
+			as.Equal("b2", v)
+			stats, err := b2.Stats()
+			as.Nil(err)
+			as.Equal(int64(1), stats.Keys)
+		})
+	}
+
+	t.Run("names", func(t *testing.T) {
+		os.Remove("./test-bucket")
+		c, err := filecache.Open("./test-bucket")
+		as.Nil(err)
+		defer c.Close()
+
+		_, err = c.Bucket("")
+		as.Equal(filecache.InvalidBucketName, err)
+		_, err = c.Bucket(strings.Repeat("b", 64))
+		as.Equal(filecache.InvalidBucketName, err)
+
+		for i := 0; i < 255; i++ {
+			_, err := c.Bucket(fmt.Sprintf("b%d", i))
+			as.Nil(err)
+		}
+		_, err = c.Bucket("one-more")
+		as.Equal(filecache.TooManyBuckets, err)
+		_, err = c.Bucket("b0")
+		as.Nil(err)
+	})
+}
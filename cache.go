@@ -2,13 +2,14 @@ package filecache
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/huichen/murmur"
-
 	mmap "github.com/Chyroc/filecache/internal/gommap"
 )
 
@@ -50,6 +51,7 @@ var ValueTooShort = errors.New("value too short")
 var ValueTooLong = errors.New("value too long")
 var InvalidFileSize = errors.New("invalid file size")
 var FileSizeTooLarge = errors.New("file size too large(>100M)")
+var Closed = errors.New("cache closed")
 
 const bufCount = 20 // 一个buf 5M，20个100M
 const bufSize = 5242880
@@ -60,42 +62,96 @@ const docCount = 8
 const docHeaderLength = 1 + 2 + 2 + 7
 
 const MaxLengthKey = 244
-const MaxLengthValue = 1024
+const MaxLengthValue = 1024 // 压缩前的长度，扩展头、加密增加的长度加上key一起不能超过doc的大小
 
-// 文件初始大小是5M，空间不够就扩大
+// 文件初始大小是1M+5M，空间不够就扩大，header的结构见header.go
 // 5M大小分成512个entry，4096个doc，每个doc大小是1280B，1个entry有8个doc
 // doc的结构是 flag(1), key_len(2), val_len(2), ttl(7,13ms), key, val (k+v: 1268)
+// flag中除了是否有数据，还记录了value的压缩方式、是否有扩展头和是否加密
+// slab模式下region按需分成不同大小的slot，见slab.go
 
-func New(filepath string) Cache {
+func New(filepath string, opts ...Option) Cache {
+	c, _ := open(filepath, opts)
+	return c
+}
+
+// Open 和 New 一样，但是直接返回打开文件时的错误
+func Open(filepath string, opts ...Option) (*CacheImpl, error) {
+	c, err := open(filepath, opts)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func open(filepath string, opts []Option) (*CacheImpl, error) {
 	c := &CacheImpl{
 		filepath:    filepath,
 		CurrentSize: bufSize, // B
+		options:     defaultOptions(),
+		stats:       new(stats),
+		expiry:      newExpiry(),
+	}
+	for _, opt := range opts {
+		opt(&c.options)
+	}
+	c.onEvict.callbacks = c.options.onEvict
+	if c.options.encryptionKey != nil && len(c.options.encryptionKey) < 16 {
+		c.err = InvalidEncryptionKey
+		return c, c.err
 	}
 
 	c.file, c.err = os.OpenFile(filepath, os.O_CREATE|os.O_RDWR, 0600)
 	if c.err != nil {
-		return c
+		return c, c.err
 	}
 
 	c.fileStat, c.err = c.file.Stat()
 	if c.err != nil {
-		return c
+		return c, c.err
 	}
 
 	if err := c.loadFile(); err != nil {
-		return c
+		return c, err
 	}
 
-	return c
+	if c.options.wal {
+		if err := c.openWAL(); err != nil {
+			c.err = err
+			return c, err
+		}
+	}
+
+	if c.options.index {
+		c.index = new(index)
+		if err := c.buildIndex(); err != nil {
+			c.err = err
+			return c, err
+		}
+	}
+
+	c.startExpiry()
+	return c, nil
 }
 
 type CacheImpl struct {
+	mu          sync.RWMutex
 	err         error
 	filepath    string
 	file        *os.File
 	fileStat    os.FileInfo
 	CurrentSize int
 	mmap        mmap.MMap
+	journaling  bool
+	options     options
+	wal         *wal
+	index       *index
+	stats       *stats
+	encryption  *encryption
+	loads       loadGroup
+	layout      layout
+	expiry      *expiry
+	onEvict     evictHooks
 }
 
 func (r *CacheImpl) loadFile() error {
@@ -104,13 +160,35 @@ func (r *CacheImpl) loadFile() error {
 		return r.err
 	}
 
-	if r.fileStat.Size()%bufSize != 0 {
-		r.err = InvalidFileSize
+	if r.fileStat.Size() == 0 {
+		if r.err = r.file.Truncate(headerSize); r.err != nil {
+			return r.err
+		}
+		if r.err = r.fileExpansion(); r.err != nil {
+			return r.err
+		}
+		r.initHeader()
+		if r.layout, r.err = newLayout(&r.options); r.err != nil {
+			return r.err
+		}
+		r.layout.write(r.mmap)
+		r.err = r.loadEncryption(true)
 		return r.err
 	}
 
-	if r.fileStat.Size() == 0 {
-		return r.fileExpansion()
+	if r.fileStat.Size()%bufSize == 0 {
+		// 没有header的旧版本文件
+		if r.file, r.err = upgradeFile(r.filepath, r.file); r.err != nil {
+			return r.err
+		}
+		if r.fileStat, r.err = r.file.Stat(); r.err != nil {
+			return r.err
+		}
+	}
+
+	if r.fileStat.Size() < headerSize+bufSize || (r.fileStat.Size()-headerSize)%bufSize != 0 {
+		r.err = InvalidFileSize
+		return r.err
 	}
 
 	r.mmap, r.err = mmap.Map(r.file)
@@ -118,6 +196,44 @@ func (r *CacheImpl) loadFile() error {
 		return r.err
 	}
 
+	if r.err = r.checkHeader(); r.err != nil {
+		return r.err
+	}
+
+	// 上次的事务没有完成就退出了，回滚
+	if r.err = r.recoverJournal(); r.err != nil {
+		return r.err
+	}
+
+	r.layout = readLayout(r.mmap)
+	if !r.layout.valid() {
+		r.err = InvalidFileFormat
+		return r.err
+	}
+	if r.err = r.loadEncryption(false); r.err != nil {
+		return r.err
+	}
+
+	// 之前的版本没有统计bucket的用量
+	if r.headerUint32(metaFlags)&flagUsage == 0 {
+		if r.err = r.rebuildUsage(); r.err != nil {
+			return r.err
+		}
+	}
+
+	if r.headerUint32(metaFlags)&flagDeduped == 0 {
+		if r.err = r.dedup(); r.err != nil {
+			return r.err
+		}
+		r.putHeaderUint32(metaFlags, r.headerUint32(metaFlags)|flagDeduped)
+	}
+
+	if r.headerUint32(metaFlags)&flagBloom == 0 {
+		if r.err = r.rebuildBloom(); r.err != nil {
+			return r.err
+		}
+	}
+
 	return nil
 }
 
@@ -127,24 +243,25 @@ func (r *CacheImpl) fileExpansion() error {
 		return r.err
 	}
 
-	if r.fileStat.Size()%bufSize != 0 {
+	if r.fileStat.Size() < headerSize || (r.fileStat.Size()-headerSize)%bufSize != 0 {
 		r.err = InvalidFileSize
 		return r.err
 	}
-	if r.fileStat.Size() > (bufCount-1)*bufSize { // 已经大于95M，再增加5M，就大于100M了，本库设计中，最大文件大小为100M
-		r.err = FileSizeTooLarge
-		return r.err
+	if r.blocks() >= bufCount { // 已经有20个block了，再增加5M，就大于100M了，本库设计中，最大文件大小为100M
+		return FileSizeTooLarge
 	}
 
 	fill := make([]byte, bufSize)
-	for i := 0; i < bufSize; i++ {
-		fill[i] = 0
-	}
 
 	if _, r.err = r.file.WriteAt(fill, r.fileStat.Size()); r.err != nil {
 		return r.err
 	}
 
+	if r.mmap != nil {
+		if r.err = r.mmap.Unmap(); r.err != nil {
+			return r.err
+		}
+	}
 	r.mmap, r.err = mmap.Map(r.file)
 	if r.err != nil {
 		return r.err
@@ -157,178 +274,350 @@ func (r *CacheImpl) fileExpansion() error {
 	return nil
 }
 
-func (r *CacheImpl) region(key string) int {
-	return int(murmur.Murmur3([]byte(key)) % uint32(entryCount))
+// 所有对数据区的修改都要经过这里，事务中会先把旧数据写到journal里
+func (r *CacheImpl) write(offset int, buf []byte) error {
+	if r.journaling {
+		if err := r.journalRecord(offset, len(buf)); err != nil {
+			return err
+		}
+	}
+
+	copy(r.mmap[offset:offset+len(buf)], buf)
+
+	// 每次修改都增加seq，其他进程据此知道文件被修改过
+	seq := r.headerUint64(metaSeq)
+	r.putHeaderUint64(metaSeq, seq+1)
+	r.indexFollow(seq)
+	return nil
+}
+
+func (r *CacheImpl) regions(key string) []int {
+	return r.layout.regions(key)
 }
 
 type kv struct {
 	key       string
+	rawKey    string // 文件中的key，加密并且hash了key的时候和key不同
 	val       string
-	expiredAt int // ms
-	ttl       int // ms
+	expiredAt int  // ms，软过期时间
+	ttl       int  // ms
+	grace     int  // ms，硬过期时间比软过期时间晚多少
+	ns        int  // bucket的id，0是默认的
+	flushed   bool // FlushAll之前写入的，和过了硬过期时间一样
 	offset    int
 }
 
-func (r *CacheImpl) get(key string) (*kv, error) {
-	keyLen := len(key)
+func checkKey(key string) error {
+	if len(key) > MaxLengthKey {
+		return KeyTooLong
+	} else if len(key) == 0 {
+		return KeyTooShort
+	}
+	return nil
+}
+
+func checkVal(val string, maxLen int) error {
+	if len(val) > maxLen {
+		return ValueTooLong
+	} else if len(val) == 0 {
+		return ValueTooShort
+	}
+	return nil
+}
+
+func (r *CacheImpl) get(ns int, key string) (*kv, error) {
+	kv, err := r.find(ns, key)
+	if err != nil {
+		return nil, err
+	} else if kv.ttl < 0 {
+		return nil, NotFound
+	}
+	return kv, nil
+}
+
+// 和get一样，另外返回数据是否过了硬过期时间、需要马上清理（开启了过期通知时）
+func (r *CacheImpl) getExpired(ns int, key string) (*kv, bool, error) {
+	kv, err := r.find(ns, key)
+	if err != nil {
+		return nil, false, err
+	} else if kv.ttl < 0 {
+		return nil, kv.reclaimable() && r.expireNotify(), NotFound
+	}
+	return kv, false, nil
+}
 
+// 和get一样，但是已经过期、还没有被清理的数据也会返回（ttl < 0）
+func (r *CacheImpl) find(ns int, key string) (*kv, error) {
 	if r.err != nil {
 		return nil, r.err
-	} else if keyLen > MaxLengthKey {
-		return nil, KeyTooLong
-	} else if keyLen == 0 {
-		return nil, KeyTooShort
-	}
-
-	region := r.region(key) // 0 ~ mod-1
-	keyBytes := []byte(key)
-
-	for j := 0; j < int(r.fileStat.Size())/bufSize; j++ {
-		regionOffset := j*bufSize + region*entrySize
-		for i := 0; i < docCount; i++ {
-			currentOffset := regionOffset + docLength*i
-			if r.mmap[currentOffset] == 1 {
-				// 当前有数据，判断key是否和给定的key重合
-				keyLen, err := binaryInt(r.mmap[currentOffset+1 : currentOffset+3])
-				if err != nil {
-					return nil, err
-				}
-				keyBytesFromMM := r.mmap[currentOffset+docHeaderLength : currentOffset+docHeaderLength+keyLen]
-				if !bytes.Equal(keyBytes, keyBytesFromMM) {
-					continue
-				}
+	} else if err := checkKey(key); err != nil {
+		return nil, err
+	}
 
-				expiredAt, err := binaryInt(r.mmap[currentOffset+5 : currentOffset+docHeaderLength])
-				now := int(time.Now().UnixNano() / int64(1000000))
-				ttl := expiredAt - now
-				if ttl < 0 {
-					// 过期了
-					// TODO: 删除
-					return nil, NotFound
-				}
+	id := r.storedKey(key)
+	keyBytes := []byte(id)
 
-				valLen, err := binaryInt(r.mmap[currentOffset+3 : currentOffset+5])
+	// 其他进程正在移动doc（比如Compact先写新的位置再删除旧的）时可能两边都没有看到，seq变了就再找一次
+	for i := 0; ; i++ {
+		seq := r.headerUint64(metaSeq)
+		kv, err := r.findDoc(ns, id, keyBytes)
+		if err != NotFound || i >= findRetries || r.headerUint64(metaSeq) == seq {
+			return kv, err
+		}
+	}
+}
+
+const findRetries = 3
+
+func (r *CacheImpl) findDoc(ns int, id string, keyBytes []byte) (*kv, error) {
+	if r.index != nil {
+		if offset, ok := r.indexLookup(ns, id); ok {
+			if offset < 0 {
+				return nil, NotFound
+			}
+			if kv, err := r.matchDoc(offset, ns, keyBytes); kv != nil || err != nil {
+				return kv, err
+			}
+			// 索引和文件不一致，回退到扫描
+		}
+	}
+
+	regions := r.regions(id) // 0 ~ mod-1
+
+	for j := 0; j < r.blocks(); j++ {
+		may, checked := r.bloomMayContain(j, id)
+		if !may {
+			continue
+		}
+
+		for _, region := range regions {
+			regionOffset := blockOffset(j) + region*entrySize
+			for offset := r.nextDoc(regionOffset, -1); offset >= 0; offset = r.nextDoc(regionOffset, offset) {
+				kv, err := r.matchDoc(offset, ns, keyBytes)
 				if err != nil {
 					return nil, err
+				} else if kv != nil {
+					return kv, nil
 				}
-				return &kv{
-					key:       key,
-					val:       string(r.mmap[currentOffset+docHeaderLength+keyLen : currentOffset+docHeaderLength+keyLen+valLen]),
-					expiredAt: expiredAt,
-					ttl:       ttl,
-					offset:    currentOffset,
-				}, nil
-			} else {
-				// 全部flag为1，但是没有key重合的
-				// 或者flag为0
+				// flag为0，或者key不重合
 			}
 		}
+		if checked {
+			atomic.AddUint64(&r.stats.bloomFalsePositives, 1)
+		}
 	}
 
 	return nil, NotFound
 }
 
-func (r *CacheImpl) Get(key string) (string, error) {
-	kv, err := r.get(key)
+// offset处的doc是给定bucket中的key时返回kv（包括已经过期的），不是这个key返回nil
+func (r *CacheImpl) matchDoc(offset, ns int, keyBytes []byte) (*kv, error) {
+	if !r.isUsed(offset) {
+		return nil, nil
+	}
+
+	// 当前有数据，判断key是否和给定的key重合
+	keyLen, err := binaryInt(r.mmap[offset+1 : offset+3])
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	keyBytesFromMM := r.mmap[offset+docHeaderLength : offset+docHeaderLength+keyLen]
+	if !bytes.Equal(keyBytes, keyBytesFromMM) {
+		return nil, nil
 	}
 
-	return kv.val, nil
+	kv, err := r.readDoc(offset)
+	if err != nil || kv.ns != ns || kv.flushed {
+		return nil, err
+	}
+	return kv, nil
+}
+
+func (r *CacheImpl) Get(key string) (string, error) {
+	return r.GetCtx(context.Background(), key)
 }
 
 func (r *CacheImpl) Set(key, val string, ttl time.Duration) error {
-	keyLen := len(key)
-	valLen := len(val)
+	return r.SetCtx(context.Background(), key, val, ttl)
+}
 
+// o.expiredAt是软过期时间，o.grace大于0时doc中记录的是硬过期时间expiredAt+grace
+func (r *CacheImpl) set(o *op) error {
+	key, val := o.key, o.val
 	if r.err != nil {
 		return r.err
-	} else if keyLen > MaxLengthKey {
-		return KeyTooLong
-	} else if len(val) > MaxLengthValue {
-		return ValueTooLong
-	} else if keyLen == 0 {
-		return KeyTooShort
-	} else if len(val) == 0 {
-		return ValueTooShort
+	} else if err := checkKey(key); err != nil {
+		return err
+	} else if err := checkVal(val, r.maxLengthValue()); err != nil {
+		return err
+	}
+
+	flag, stored, err := r.compress(val)
+	if err != nil {
+		return err
 	}
+	return r.setCompressed(o, flag, stored)
+}
 
-	region := r.region(key) // 0 ~ 511
-	regionOffset := region * docCount * docLength
-	keyBytes := []byte(key)
+// 写入已经压缩过的value，flag是doc flag中压缩方式的bit
+func (r *CacheImpl) setCompressed(o *op, flag byte, stored []byte) error {
+	key, ns := o.key, int(o.ns)
+	id := r.storedKey(key)
+	flag, stored, err := r.encrypt(flag, id, key, stored)
+	if err != nil {
+		return err
+	}
+	epoch := r.epoch()
+	flag, stored = (extHeader{grace: int(o.grace), ns: ns, epoch: epoch}).wrap(flag, stored)
+	keyLen := len(id)
+	valLen := len(stored)
 
-	offset := -1
-	for j := 0; j < bufCount && offset < 0; j++ {
-		for i := 0; i < docCount; i++ {
-			currentOffset := bufSize*j + regionOffset + docLength*i
-			if r.mmap[currentOffset] == 1 {
-				// 当前有数据，判断key是否和给定的key重合
-				keyLen, err := binaryInt(r.mmap[currentOffset+1 : currentOffset+3])
-				if err != nil {
-					return err
-				}
-				keyBytesFromMM := r.mmap[currentOffset+docHeaderLength : currentOffset+docHeaderLength+keyLen]
-				if bytes.Equal(keyBytes, keyBytesFromMM) {
-					offset = currentOffset
-					break
+	regions := r.regions(id) // 0 ~ 511
+	keyBytes := []byte(id)
+	docLen := docHeaderLength + keyLen + valLen
+	// 扩展头、加密增加的长度用key没有用完的空间，key不长的时候MaxLengthValue的value总是放得下
+	if docLen > docLength {
+		return ValueTooLong
+	}
+	if err := r.checkQuota(ns, key, docLen); err != nil {
+		return err
+	}
+
+	block, blockRegion := -1, -1 // 第一个有空位的block中，空位最多的region
+	var copies []int             // key已经存在的doc，正常情况下最多只有一个
+	for j := 0; j < r.blocks(); j++ {
+		freeRegion, freeSize := -1, 0
+		for _, region := range regions {
+			regionOffset := blockOffset(j) + region*entrySize
+			free := r.slabTailFree(j, region, docLen)
+			for currentOffset := r.nextDoc(regionOffset, -1); currentOffset >= 0; currentOffset = r.nextDoc(regionOffset, currentOffset) {
+				if r.isUsed(currentOffset) {
+					// 当前有数据，判断key是否和给定的key重合
+					keyLen, err := binaryInt(r.mmap[currentOffset+1 : currentOffset+3])
+					if err != nil {
+						return err
+					}
+					keyBytesFromMM := r.mmap[currentOffset+docHeaderLength : currentOffset+docHeaderLength+keyLen]
+					if !bytes.Equal(keyBytes, keyBytesFromMM) {
+						// FlushAll之前写入的可以当作空位，alloc的时候释放
+						if size := r.slotSize(currentOffset); size >= docLen && r.isFlushed(currentOffset) {
+							free += size
+						}
+						continue
+					}
+					// FlushAll之前写入的也顺便删除
+					if ext, _, err := r.docExtHeader(currentOffset); err != nil {
+						return err
+					} else if ext.ns == ns || ext.epoch != epoch {
+						copies = append(copies, currentOffset)
+					}
+				} else if size := r.slotSize(currentOffset); size >= docLen {
+					free += size
 				}
-			} else if offset < 0 { // r.mmap[currentOffset] == 0
-				// 将第一个遇见的0doc给offset
-				offset = currentOffset
-			} else {
-				// 全部flag为1，但是没有key重合的
+			}
+			if free > freeSize {
+				freeRegion, freeSize = region, free
 			}
 		}
+		if block < 0 && freeRegion >= 0 {
+			block, blockRegion = j, freeRegion
+		}
+	}
 
-		// 当前文件快没有找到，并且下一次寻址的文件块尚未填充数据
-		if offset < 0 && r.fileStat.Size() <= int64((j+1)*bufSize) {
-			if err := r.fileExpansion(); err != nil {
-				return err
-			}
+	for _, other := range copies {
+		if err := r.expireCopy(other, epoch); err != nil {
+			return err
 		}
 	}
 
+	offset := -1
+	if len(copies) > 0 && r.slotSize(copies[0]) >= docLen {
+		// 前面的block中有空的doc也不能写到那里，否则后面block中的旧数据还在，del之后又能get到
+		// 写到get能读到的第一份，其他的在写完之后删除
+		offset, copies = copies[0], copies[1:]
+	} else if block >= 0 {
+		// slab模式下原来的slot可能放不下，换一个位置写，旧的在写完之后删除
+		var err error
+		if offset, err = r.alloc(block, blockRegion, docLen); err != nil {
+			return err
+		}
+	}
 	if offset < 0 {
-		return HashConflict
+		// 所有文件块中这个key可以使用的region都满了，扩容
+		atomic.AddUint64(&r.stats.hashConflicts, 1)
+		if err := r.fileExpansion(); err != nil {
+			return err
+		}
+		var err error
+		if offset, err = r.alloc(r.blocks()-1, regions[0], docLen); err != nil {
+			return err
+		}
 	}
 
-	docLen := docHeaderLength + keyLen + valLen
-
 	buf := make([]byte, docLen) // TODO: use sync.Pool
-	buf[0] = 1
+	buf[0] = flag
 	binary.PutVarint(buf[1:3], int64(keyLen))
 	binary.PutVarint(buf[3:5], int64(valLen))
-	binary.PutVarint(buf[5:docHeaderLength], unixMs(ttl))
-	copy(buf[docHeaderLength:docHeaderLength+keyLen], key)
-	copy(buf[docHeaderLength+keyLen:docLen], val)
+	binary.PutVarint(buf[5:docHeaderLength], o.expiredAt+o.grace)
+	copy(buf[docHeaderLength:docHeaderLength+keyLen], id)
+	copy(buf[docHeaderLength+keyLen:docLen], stored)
 
-	copy(r.mmap[offset:offset+docLen], buf[:])
+	if err := r.writeDoc(offset, buf); err != nil {
+		return err
+	}
+	for _, other := range copies {
+		if err := r.freeDoc(other); err != nil {
+			return err
+		}
+	}
+	r.bloomAdd((offset-headerSize)/bufSize, id)
+	r.indexPut(ns, id, offset)
+	return r.logChange(EventSet, ns, key)
+}
 
-	return nil
+// 之前版本的set在前面的block有空doc时不会检查后面的block，同一个key可能会有多份
+// 只保留get能读到的第一份
+func (r *CacheImpl) dedup() error {
+	seen := make(map[string]bool)
+	return r.scan(func(kv *kv) error {
+		if k := nsKey(kv.ns, kv.rawKey); !seen[k] {
+			seen[k] = true
+			return nil
+		}
+		return r.freeDoc(kv.offset)
+	})
 }
 
 func (r *CacheImpl) TTL(key string) (time.Duration, error) {
-	kv, err := r.get(key)
-	if err != nil {
-		return 0, err
-	}
-
-	return time.Duration(kv.ttl) * time.Millisecond, nil
+	return r.TTLCtx(context.Background(), key)
 }
 
 func (r *CacheImpl) Expire(key string, ttl time.Duration) error {
-	kv, err := r.get(key)
+	return r.ExpireCtx(context.Background(), key, ttl)
+}
+
+func (r *CacheImpl) expire(ns int, key string, expiredAt int64) error {
+	kv, err := r.get(ns, key)
 	if err != nil {
 		return err
 	}
 
-	binary.PutVarint(r.mmap[kv.offset+5:kv.offset+docHeaderLength], unixMs(ttl))
+	// 宽限期保持不变
+	buf := make([]byte, docHeaderLength-5)
+	binary.PutVarint(buf, expiredAt+int64(kv.grace))
 
-	return nil
+	if err := r.write(kv.offset+5, buf); err != nil {
+		return err
+	}
+	return r.logChange(EventExpire, ns, key)
 }
 
 func (r *CacheImpl) Del(key string) error {
-	kv, err := r.get(key)
+	return r.DelCtx(context.Background(), key)
+}
+
+func (r *CacheImpl) del(ns int, key string) error {
+	kv, err := r.get(ns, key)
 	if err != nil {
 		if err == NotFound {
 			return nil
@@ -336,47 +625,250 @@ func (r *CacheImpl) Del(key string) error {
 		return err
 	}
 
-	r.mmap[kv.offset] = 0
+	if err := r.freeDoc(kv.offset); err != nil {
+		return err
+	}
+	r.indexDel(kv.ns, kv.rawKey)
+	return r.logChange(EventDel, ns, key)
+}
+
+const (
+	opSet = iota + 1
+	opDel
+	opExpire
+	opBucket // 注册bucket，key是bucket的名字，val是quota，见bucket.go
+)
+
+// op 是一次修改操作，Set/Del/Expire和事务都会转换成op，wal里记录的也是op
+type op struct {
+	kind      byte
+	key       string
+	val       string
+	expiredAt int64 // ms
+	grace     int64 // ms，只有opSet有
+	ns        byte  // bucket的id
+}
+
+func (o *op) check(maxLengthValue int) error {
+	if o.kind == opBucket {
+		return checkBucketName(o.key)
+	}
+	if err := checkKey(o.key); err != nil {
+		return err
+	}
+	if o.kind == opSet {
+		return checkVal(o.val, maxLengthValue)
+	}
 	return nil
 }
 
+func (r *CacheImpl) apply(o *op) error {
+	switch o.kind {
+	case opSet:
+		return r.set(o)
+	case opDel:
+		return r.del(int(o.ns), o.key)
+	case opExpire:
+		return r.expire(int(o.ns), o.key, o.expiredAt)
+	case opBucket:
+		return r.putBucket(o)
+	}
+	return InvalidFileFormat
+}
+
+// 一组op要么全部成功，要么全部失败，开启了wal的话会先写wal
+func (r *CacheImpl) mutate(ops []*op) error {
+	if r.err != nil {
+		return r.err
+	}
+	for _, o := range ops {
+		if err := o.check(r.maxLengthValue()); err != nil {
+			return err
+		}
+	}
+
+	var walSize int64
+	if r.wal != nil {
+		if err := r.wal.lock(); err != nil {
+			return err
+		}
+		defer r.wal.unlock()
+
+		var err error
+		if walSize, err = r.wal.append(ops); err != nil {
+			return err
+		}
+	}
+
+	if err := r.applyAll(ops); err != nil {
+		// 修改失败了，wal里也不能留下这条记录
+		if r.wal != nil {
+			if werr := r.wal.truncate(walSize); werr != nil {
+				return werr
+			}
+		}
+		return err
+	}
+
+	return r.maybeCheckpoint()
+}
+
+func (r *CacheImpl) applyAll(ops []*op) error {
+	if len(ops) == 1 {
+		return r.apply(ops[0])
+	}
+
+	r.journalBegin()
+	for _, o := range ops {
+		if err := r.apply(o); err != nil {
+			if rerr := r.journalRollback(); rerr != nil {
+				return rerr
+			}
+			return err
+		}
+	}
+
+	return r.journalEnd()
+}
+
 func (r *CacheImpl) Range() ([]*KV, error) {
+	return r.RangeCtx(context.Background())
+}
+
+// 返回bucket中没有过期的数据，顺便清理所有bucket中过了硬过期时间的数据
+// ctx结束时停止遍历，已经清理掉的数据不会恢复
+func (r *CacheImpl) rangeKV(ctx context.Context, ns int) ([]*KV, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+
 	var kvs []*KV
-	for bufID := 0; bufID < int(r.fileStat.Size())/bufSize; bufID++ {
-		for entryID := 0; entryID < entryCount; entryID++ {
-			regionOffset := bufID*bufSize + entryID*entrySize
-			for docID := 0; docID < docCount; docID++ {
-				currentOffset := regionOffset + docLength*docID
-				if r.mmap[currentOffset] == 1 {
-					keyLen, err := binaryInt(r.mmap[currentOffset+1 : currentOffset+3])
-					if err != nil {
-						return nil, err
-					}
-					keyBytes := r.mmap[currentOffset+docHeaderLength : currentOffset+docHeaderLength+keyLen]
-
-					expiredAt, err := binaryInt(r.mmap[currentOffset+5 : currentOffset+docHeaderLength])
-					now := int(time.Now().UnixNano() / int64(1000000))
-					ttl := expiredAt - now
-					if ttl < 0 {
-						if err := r.Del(string(keyBytes)); err != nil {
-							return nil, err
-						}
-						continue
-					}
+	n := 0
+	err := r.scan(func(kv *kv) error {
+		if n++; n%scanCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		if kv.reclaimable() {
+			// 过了硬过期时间，顺便删除
+			return r.reclaim(kv)
+		} else if kv.ttl < 0 || kv.ns != ns {
+			// 宽限期内的只有GetStale能读到
+			return nil
+		}
+		kvs = append(kvs, &KV{
+			Key: kv.key,
+			Val: kv.val,
+			TTL: time.Duration(kv.ttl) * time.Millisecond,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-					valLen, err := binaryInt(r.mmap[currentOffset+3 : currentOffset+5])
-					if err != nil {
-						return nil, err
-					}
-					kvs = append(kvs, &KV{
-						Key: string(keyBytes),
-						Val: string(r.mmap[currentOffset+docHeaderLength+keyLen : currentOffset+docHeaderLength+keyLen+valLen]),
-						TTL: time.Duration(currentOffset) * time.Millisecond,
-					})
+	return kvs, nil
+}
+
+// 遍历所有有数据的doc，包括已经过期的（ttl < 0）
+func (r *CacheImpl) scan(fn func(kv *kv) error) error {
+	return r.walk(func(offset int) error {
+		kv, err := r.readDoc(offset)
+		if err != nil {
+			return err
+		}
+		return fn(kv)
+	})
+}
+
+// 和scan一样，但是只给出doc的offset，不解码value
+func (r *CacheImpl) walk(fn func(offset int) error) error {
+	for bufID := 0; bufID < r.blocks(); bufID++ {
+		for entryID := 0; entryID < entryCount; entryID++ {
+			regionOffset := blockOffset(bufID) + entryID*entrySize
+			for currentOffset := r.nextDoc(regionOffset, -1); currentOffset >= 0; currentOffset = r.nextDoc(regionOffset, currentOffset) {
+				if !r.isUsed(currentOffset) {
+					continue
+				}
+				if err := fn(currentOffset); err != nil {
+					return err
 				}
 			}
 		}
 	}
 
-	return kvs, nil
+	return nil
+}
+
+func (r *CacheImpl) readDoc(offset int) (*kv, error) {
+	keyLen, err := binaryInt(r.mmap[offset+1 : offset+3])
+	if err != nil {
+		return nil, err
+	}
+	valLen, err := binaryInt(r.mmap[offset+3 : offset+5])
+	if err != nil {
+		return nil, err
+	}
+	expiredAt, err := binaryInt(r.mmap[offset+5 : offset+docHeaderLength])
+	if err != nil {
+		return nil, err
+	}
+	rawKey := r.mmap[offset+docHeaderLength : offset+docHeaderLength+keyLen]
+	ext, rawVal, err := splitExt(r.mmap[offset], r.mmap[offset+docHeaderLength+keyLen:offset+docHeaderLength+keyLen+valLen])
+	if err != nil {
+		return nil, err
+	}
+	key, val, err := r.decodeValue(r.mmap[offset], rawKey, rawVal)
+	if err != nil {
+		return nil, err
+	}
+	now := int(time.Now().UnixNano() / int64(1000000))
+
+	return &kv{
+		key:       key,
+		rawKey:    string(rawKey),
+		val:       val,
+		expiredAt: expiredAt - ext.grace,
+		ttl:       expiredAt - ext.grace - now,
+		grace:     ext.grace,
+		ns:        ext.ns,
+		flushed:   ext.epoch != r.epoch(),
+		offset:    offset,
+	}, nil
+}
+
+func (r *CacheImpl) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err == Closed {
+		return nil
+	}
+
+	if r.wal != nil && r.mmap != nil {
+		if err := r.lockedCheckpoint(); err != nil {
+			return err
+		}
+	}
+	if r.wal != nil {
+		if err := r.wal.file.Close(); err != nil {
+			return err
+		}
+		r.wal = nil
+	}
+	if r.mmap != nil {
+		if err := r.mmap.Unmap(); err != nil {
+			return err
+		}
+	}
+	if r.file != nil {
+		if err := r.file.Close(); err != nil {
+			return err
+		}
+	}
+
+	r.err = Closed
+	r.stopExpiry()
+	return nil
 }
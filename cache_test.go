@@ -1,7 +1,9 @@
 package filecache_test
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"math"
 	"os"
 	"strconv"
@@ -145,6 +147,78 @@ func TestNew(t *testing.T) {
 		as.Nil(c.Set("63125", "63125", time.Second))
 	})
 
+	t.Run("upgrade old file", func(t *testing.T) {
+		as.Nil(os.Remove("./test"))
+		f, err := os.Create("./test")
+		as.Nil(err)
+		as.Nil(f.Truncate(5242880))
+		as.Nil(f.Close())
+
+		c = filecache.New("./test").(*filecache.CacheImpl)
+		as.Nil(c.Set("k", "v", time.Second))
+
+		fi, err := os.Stat("./test")
+		as.Nil(err)
+		as.Equal(int64(1048576+5242880), fi.Size())
+	})
+
+	t.Run("single copy across blocks", func(t *testing.T) {
+		as.Nil(os.Remove("./test"))
+		c = filecache.New("./test").(*filecache.CacheImpl)
+
+		// 一直写到第二个block，最后写的key在第二个block中
+		var keys []string
+		for i := 0; ; i++ {
+			j := strconv.Itoa(i)
+			as.Nil(c.Set(j, j, time.Minute))
+			keys = append(keys, j)
+
+			fi, err := os.Stat("./test")
+			as.Nil(err)
+			if fi.Size() > 1048576+5242880 {
+				break
+			}
+		}
+		last := keys[len(keys)-1]
+
+		// 第一个block中空出位置之后，再set不能在第一个block中留下第二份
+		for _, k := range keys[:len(keys)-1] {
+			as.Nil(c.Del(k))
+		}
+		as.Nil(c.Set(last, "new", time.Minute))
+		v, err := c.Get(last)
+		as.Nil(err)
+		as.Equal("new", v)
+
+		as.Nil(c.Del(last))
+		_, err = c.Get(last)
+		as.Equal(filecache.NotFound, err)
+	})
+
+	t.Run("dedup old file", func(t *testing.T) {
+		as.Nil(os.Remove("./test"))
+		c = filecache.New("./test").(*filecache.CacheImpl)
+		as.Nil(c.Set("k", "new", time.Minute))
+
+		// 去掉header得到旧版本的文件，再在第二个block中放一份旧数据
+		data, err := ioutil.ReadFile("./test")
+		as.Nil(err)
+		data = append(data[1048576:], make([]byte, 5242880)...)
+		offset := bytes.Index(data, []byte("knew")) - 12
+		copy(data[offset+5242880:], data[offset:offset+1280])
+		copy(data[offset+5242880+13:], "old")
+		as.Nil(ioutil.WriteFile("./test", data, 0600))
+
+		c = filecache.New("./test").(*filecache.CacheImpl)
+		v, err := c.Get("k")
+		as.Nil(err)
+		as.Equal("new", v)
+
+		as.Nil(c.Del("k"))
+		_, err = c.Get("k")
+		as.Equal(filecache.NotFound, err)
+	})
+
 	t.Run("large count get set del", func(t *testing.T) {
 		as.Nil(os.Remove("./test"))
 		c = filecache.New("./test").(*filecache.CacheImpl)
@@ -229,6 +303,48 @@ func BenchmarkFileCache(b *testing.B) {
 		}
 	})
 
+	b.Run("chyroc-miss", func(b *testing.B) {
+		file := "./test-file-chyroc-miss"
+		defer os.RemoveAll(file)
+		os.RemoveAll(file)
+
+		c := chyrocFileCache.New(file)
+		for i := 0; i <= 20000; i++ {
+			j := strconv.Itoa(i)
+			as.Nil(c.Set(j, j, time.Minute))
+		}
+
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			for i := 0; i <= 1000; i++ {
+				_, err := c.Get("miss-" + strconv.Itoa(i))
+				as.Equal(chyrocFileCache.NotFound, err)
+			}
+		}
+	})
+
+	b.Run("chyroc-index-miss", func(b *testing.B) {
+		file := "./test-file-chyroc-index-miss"
+		defer os.RemoveAll(file)
+		os.RemoveAll(file)
+
+		c := chyrocFileCache.New(file, chyrocFileCache.WithIndex())
+		for i := 0; i <= 20000; i++ {
+			j := strconv.Itoa(i)
+			as.Nil(c.Set(j, j, time.Minute))
+		}
+
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			for i := 0; i <= 1000; i++ {
+				_, err := c.Get("miss-" + strconv.Itoa(i))
+				as.Equal(chyrocFileCache.NotFound, err)
+			}
+		}
+	})
+
 	b.Run("huntsman", func(b *testing.B) {
 		for _, v := range []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9", "a", "b", "c", "d", "e", "f"} {
 			defer os.RemoveAll(v)
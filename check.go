@@ -0,0 +1,282 @@
+package filecache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// 过期时间超过这个范围的认为是坏数据
+const maxExpireRange = 100 * 365 * 24 * time.Hour
+
+type Problem struct {
+	Offset int
+	Block  int
+	Region int
+	Doc    int
+	Key    string
+	Reason string
+}
+
+func (p *Problem) String() string {
+	if p.Offset < 0 {
+		return p.Reason
+	}
+	if p.Key != "" {
+		return fmt.Sprintf("block %d region %d doc %d (offset %d, key %q): %s", p.Block, p.Region, p.Doc, p.Offset, p.Key, p.Reason)
+	}
+	return fmt.Sprintf("block %d region %d doc %d (offset %d): %s", p.Block, p.Region, p.Doc, p.Offset, p.Reason)
+}
+
+type Report struct {
+	Blocks   int
+	Docs     int // 有数据的doc
+	Expired  int
+	Problems []*Problem
+}
+
+func (r *Report) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// Check 只读地检查文件，不会修改文件，也不会回滚没有完成的事务
+func Check(path string) (*Report, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return checkImage(data, nil), nil
+}
+
+// Repair 把path修复后写到out，path本身不会被修改
+// 没有完成的事务会被回滚，坏的doc会被清掉，同一个key有多份的时候只保留get能读到的那一份
+// 先在原始的数据上检查并清掉坏的doc，再打开修复后的文件回滚事务、重建slab分配表等
+// 加密的文件需要通过opts传入加密的key
+func Repair(path, out string, opts ...Option) (*Report, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	report := checkImage(data, func(offset int) {
+		data[offset] &= docClassMask
+	})
+	if err := ioutil.WriteFile(out, data, 0600); err != nil {
+		return nil, err
+	}
+
+	c, err := open(out, opts)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	defer c.Close()
+
+	// 清掉的slot放回空闲链表，无法解析的部分清空
+	if err := c.rebuildSlab(); err != nil {
+		return nil, err
+	}
+	if err := c.rebuildUsage(); err != nil {
+		return nil, err
+	}
+	if err := c.mmap.Flush(); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// 检查时记录的每个key第一份有效的doc
+type checkedDoc struct {
+	problem *Problem
+	rank    int // get读的顺序，越小越先读到
+	expired bool
+}
+
+func checkImage(data []byte, clear func(offset int)) *Report {
+	report := new(Report)
+	addProblem := func(offset int, reason string) {
+		report.Problems = append(report.Problems, &Problem{Offset: offset, Reason: reason})
+	}
+
+	base := headerSize
+	switch {
+	case len(data) > 0 && len(data)%bufSize == 0:
+		addProblem(-1, "old file format without header, will be upgraded when opened")
+		base = 0
+	case len(data) < headerSize+bufSize || (len(data)-headerSize)%bufSize != 0:
+		addProblem(-1, fmt.Sprintf("invalid file size %d", len(data)))
+		return report
+	case !bytes.Equal(data[metaMagic:metaMagic+len(headerMagic)], []byte(headerMagic)):
+		addProblem(-1, "invalid header magic")
+		return report
+	case binary.LittleEndian.Uint32(data[metaVersion:]) != headerVersion:
+		addProblem(-1, fmt.Sprintf("unsupported version %d", binary.LittleEndian.Uint32(data[metaVersion:])))
+		return report
+	case data[metaJournalState] != 0:
+		addProblem(-1, "unfinished transaction in journal")
+	}
+
+	var l layout
+	var epoch int
+	if base > 0 {
+		epoch = int(binary.LittleEndian.Uint32(data[metaEpoch:]))
+		l = readLayout(data)
+		if !l.valid() {
+			addProblem(-1, fmt.Sprintf("unknown layout: hasher %d, placement %d, allocator %d", l.hasher, l.placement, l.allocator))
+			return report
+		}
+	}
+
+	now := time.Now()
+	seen := make(map[string]*checkedDoc)
+	report.Blocks = (len(data) - base) / bufSize
+	for bufID := 0; bufID < report.Blocks; bufID++ {
+		for entryID := 0; entryID < entryCount; entryID++ {
+			regionOffset := base + bufID*bufSize + entryID*entrySize
+			end := regionOffset
+			docID := -1
+			for offset := nextDoc(data, l.allocator, regionOffset, -1); offset >= 0; offset = nextDoc(data, l.allocator, regionOffset, offset) {
+				docID++
+				end = offset + slotSize(data, l.allocator, offset)
+				if data[offset]&docUsed == 0 {
+					continue
+				}
+				report.Docs++
+
+				key, ext, reason := checkDoc(data[offset:end], l.allocator, now)
+				regionIndex := indexInt(l.regions(key), entryID)
+				if reason == "" && regionIndex < 0 {
+					reason = "key in wrong region"
+				}
+				if reason == "" && ext.epoch > epoch {
+					reason = fmt.Sprintf("epoch %d newer than header epoch %d", ext.epoch, epoch)
+				} else if reason == "" && ext.epoch < epoch {
+					// FlushAll之前写入的，还没有被清理
+					report.Expired++
+					continue
+				}
+				if reason == "" && ext.ns > 0 && (base == 0 || data[bucketEntry(ext.ns)] == 0) {
+					reason = fmt.Sprintf("unknown bucket %d", ext.ns)
+				}
+				if reason == "" {
+					expiredAt, _ := binaryInt(data[offset+5 : offset+docHeaderLength])
+					doc := &checkedDoc{
+						problem: &Problem{Offset: offset, Block: bufID, Region: entryID, Doc: docID, Key: key},
+						// get按block的顺序、每个block中按regions的顺序查找
+						rank:    bufID*len(l.regions(key)) + regionIndex,
+						expired: int64(expiredAt) < now.UnixNano()/int64(time.Millisecond),
+					}
+					first, ok := seen[nsKey(ext.ns, key)]
+					switch {
+					case !ok:
+						seen[nsKey(ext.ns, key)] = doc
+					case doc.rank < first.rank:
+						// 后面检查到的这一份get先读到，之前的那一份是多余的
+						first.problem.Reason = fmt.Sprintf("duplicate key, get reads the copy at offset %d", offset)
+						report.Problems = append(report.Problems, first.problem)
+						if first.expired {
+							report.Expired--
+						}
+						if clear != nil {
+							clear(first.problem.Offset)
+						}
+						seen[nsKey(ext.ns, key)] = doc
+					default:
+						reason = fmt.Sprintf("duplicate key, get reads the copy at offset %d", first.problem.Offset)
+					}
+				}
+				if reason == "" {
+					if seen[nsKey(ext.ns, key)].expired {
+						report.Expired++
+					}
+					continue
+				}
+
+				report.Problems = append(report.Problems, &Problem{
+					Offset: offset,
+					Block:  bufID,
+					Region: entryID,
+					Doc:    docID,
+					Key:    key,
+					Reason: reason,
+				})
+				if clear != nil {
+					clear(offset)
+				}
+			}
+
+			// slab模式下region中剩下的部分应该是还没有分配的
+			if l.allocator == AllocSlab && end < regionOffset+entrySize && data[end] != 0 {
+				report.Problems = append(report.Problems, &Problem{
+					Offset: end,
+					Block:  bufID,
+					Region: entryID,
+					Doc:    docID + 1,
+					Reason: fmt.Sprintf("invalid slab slot flag %d", data[end]),
+				})
+			}
+		}
+	}
+
+	return report
+}
+
+// 返回doc的key和扩展头，以及doc有问题时的原因
+func checkDoc(doc []byte, allocator Allocator, now time.Time) (string, extHeader, string) {
+	flags := byte(docUsed | docCodecMask | docExt | docEncrypted)
+	if allocator == AllocSlab {
+		flags |= docClassMask
+	}
+	if doc[0]&^flags != 0 {
+		return "", extHeader{}, fmt.Sprintf("invalid flag %d", doc[0])
+	}
+
+	keyLen, err := binaryInt(doc[1:3])
+	if err != nil {
+		return "", extHeader{}, "invalid key length: " + err.Error()
+	} else if keyLen <= 0 || keyLen > MaxLengthKey {
+		return "", extHeader{}, fmt.Sprintf("invalid key length %d", keyLen)
+	}
+	valLen, err := binaryInt(doc[3:5])
+	if err != nil {
+		return "", extHeader{}, "invalid value length: " + err.Error()
+	} else if valLen <= 0 || valLen > docLength-docHeaderLength-keyLen {
+		return "", extHeader{}, fmt.Sprintf("invalid value length %d", valLen)
+	}
+	if docHeaderLength+keyLen+valLen > len(doc) {
+		return "", extHeader{}, fmt.Sprintf("doc length %d larger than slot %d", docHeaderLength+keyLen+valLen, len(doc))
+	}
+	key := string(doc[docHeaderLength : docHeaderLength+keyLen])
+	ext, val, err := splitExt(doc[0], doc[docHeaderLength+keyLen:docHeaderLength+keyLen+valLen])
+	if err != nil {
+		return key, ext, "invalid doc ext: " + err.Error()
+	}
+	// 加密的value没有key不能检查
+	if doc[0]&docEncrypted == 0 {
+		if _, err := decompress(doc[0], val); err != nil {
+			return key, ext, err.Error()
+		}
+	}
+
+	expiredAt, err := binaryInt(doc[5:docHeaderLength])
+	if err != nil {
+		return key, ext, "invalid expire time: " + err.Error()
+	}
+	if expiredAt <= 0 || time.Duration(int64(expiredAt)-now.UnixNano()/int64(time.Millisecond))*time.Millisecond > maxExpireRange {
+		return key, ext, fmt.Sprintf("expire time out of range: %d", expiredAt)
+	}
+
+	return key, ext, ""
+}
+
+func indexInt(list []int, i int) int {
+	for j, v := range list {
+		if v == i {
+			return j
+		}
+	}
+	return -1
+}
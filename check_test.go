@@ -0,0 +1,104 @@
+package filecache_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Chyroc/filecache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck(t *testing.T) {
+	as := assert.New(t)
+	defer os.Remove("./test-check")
+	defer os.Remove("./test-check.repaired")
+
+	os.Remove("./test-check")
+	c, err := filecache.Open("./test-check")
+	as.Nil(err)
+	as.Nil(c.Set("good", "1", time.Minute))
+	as.Nil(c.Set("corrupt-me", "2", time.Minute))
+	as.Nil(c.Set("dup", "3", time.Minute))
+	as.Nil(c.Close())
+
+	t.Run("ok", func(t *testing.T) {
+		report, err := filecache.Check("./test-check")
+		as.Nil(err)
+		as.True(report.OK())
+		as.Equal(1, report.Blocks)
+		as.Equal(3, report.Docs)
+	})
+
+	t.Run("problems", func(t *testing.T) {
+		data, err := ioutil.ReadFile("./test-check")
+		as.Nil(err)
+
+		// 坏的flag，header的修改记录中也有key，从第一个block开始找
+		offset := 1048576 + bytes.Index(data[1048576:], []byte("corrupt-me")) - 12
+		data[offset] = 7
+
+		// 同一个key在第二个block里还有一份
+		offset = 1048576 + bytes.Index(data[1048576:], []byte("dup")) - 12
+		data = append(data, make([]byte, 5242880)...)
+		copy(data[offset+5242880:offset+5242880+1280], data[offset:offset+1280])
+		as.Nil(ioutil.WriteFile("./test-check", data, 0600))
+
+		report, err := filecache.Check("./test-check")
+		as.Nil(err)
+		as.False(report.OK())
+		as.Equal(2, report.Blocks)
+		as.Len(report.Problems, 2)
+	})
+
+	t.Run("repair", func(t *testing.T) {
+		report, err := filecache.Repair("./test-check", "./test-check.repaired")
+		as.Nil(err)
+		as.Len(report.Problems, 2)
+
+		report, err = filecache.Check("./test-check.repaired")
+		as.Nil(err)
+		as.True(report.OK())
+		as.Equal(2, report.Docs)
+
+		c := filecache.New("./test-check.repaired")
+		v, err := c.Get("dup")
+		as.Nil(err)
+		as.Equal("3", v)
+		_, err = c.Get("corrupt-me")
+		as.Equal(filecache.NotFound, err)
+	})
+
+	t.Run("repair two choice", func(t *testing.T) {
+		os.Remove("./test-check")
+		c, err := filecache.Open("./test-check", filecache.WithPlacement(filecache.PlacementTwoChoice))
+		as.Nil(err)
+		as.Nil(c.Set("dup", "1", time.Minute))
+		as.Nil(c.Close())
+
+		// murmur3没有seed，dup的两个region依次是477和294，get先读477中的这一份
+		data, err := ioutil.ReadFile("./test-check")
+		as.Nil(err)
+		offset := 1048576 + bytes.Index(data[1048576:], []byte("dup")) - 12
+		as.Equal(1048576+477*10240, offset)
+		other := 1048576 + 294*10240
+		copy(data[other:other+1280], data[offset:offset+1280])
+		data[other+12+len("dup")] = '2'
+		as.Nil(ioutil.WriteFile("./test-check", data, 0600))
+
+		report, err := filecache.Repair("./test-check", "./test-check.repaired")
+		as.Nil(err)
+		as.Len(report.Problems, 1)
+		as.Equal(other, report.Problems[0].Offset)
+
+		c, err = filecache.Open("./test-check.repaired")
+		as.Nil(err)
+		defer c.Close()
+		v, err := c.Get("dup")
+		as.Nil(err)
+		as.Equal("1", v)
+		as.Equal(1, c.Len())
+	})
+}
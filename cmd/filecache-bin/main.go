@@ -1,16 +1,46 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"github.com/Chyroc/filecache"
 	"log"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/urfave/cli"
 )
 
+// 加密的文件通过环境变量传入key，避免出现在命令行参数中
+// FILECACHE_KEY: hex编码的key，FILECACHE_HASH_KEYS=1: 新建文件时hash key
+func cacheOptions() []filecache.Option {
+	key, err := envKey("FILECACHE_KEY")
+	if err != nil {
+		log.Fatal(err)
+	} else if key == nil {
+		return nil
+	}
+	return []filecache.Option{filecache.WithEncryption(key, os.Getenv("FILECACHE_HASH_KEYS") == "1")}
+}
+
+func envKey(name string) ([]byte, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil, nil
+	}
+	key, err := hex.DecodeString(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", name, err)
+	}
+	return key, nil
+}
+
 func cmdGet() cli.Command {
 	var file string
 	return cli.Command{
@@ -23,7 +53,7 @@ func cmdGet() cli.Command {
 			} else if file == "" {
 				return fmt.Errorf("invalid file path")
 			}
-			val, err := filecache.New(file).Get(c.Args()[0])
+			val, err := filecache.New(file, cacheOptions()...).Get(c.Args()[0])
 			if err != nil {
 				return err
 			}
@@ -55,7 +85,7 @@ func cmdSet() cli.Command {
 			if err != nil {
 				return fmt.Errorf("invalid ttl seconds param")
 			}
-			if err := filecache.New(file).Set(c.Args()[0], c.Args()[1], time.Duration(ttl)*time.Second); err != nil {
+			if err := filecache.New(file, cacheOptions()...).Set(c.Args()[0], c.Args()[1], time.Duration(ttl)*time.Second); err != nil {
 				return err
 			}
 			fmt.Println("OK")
@@ -82,7 +112,7 @@ func cmdTTL() cli.Command {
 			} else if file == "" {
 				return fmt.Errorf("invalid file path")
 			}
-			ttl, err := filecache.New(file).TTL(c.Args()[0])
+			ttl, err := filecache.New(file, cacheOptions()...).TTL(c.Args()[0])
 			if err != nil {
 				return err
 			}
@@ -111,7 +141,7 @@ func cmdDel() cli.Command {
 				return fmt.Errorf("invalid file path")
 			}
 
-			if err := filecache.New(file).Del(c.Args()[0]); err != nil {
+			if err := filecache.New(file, cacheOptions()...).Del(c.Args()[0]); err != nil {
 				return err
 			}
 			fmt.Println("OK")
@@ -137,7 +167,7 @@ func cmdRange() cli.Command {
 				return fmt.Errorf("invalid file path")
 			}
 
-			kvs, err := filecache.New(file).Range()
+			kvs, err := filecache.New(file, cacheOptions()...).Range()
 			if err != nil {
 				return err
 			}
@@ -155,6 +185,417 @@ func cmdRange() cli.Command {
 	}
 }
 
+func cmdBackup() cli.Command {
+	var file string
+	var raw bool
+	return cli.Command{
+		Name:        "backup",
+		Description: "backup filecache file to a snapshot",
+		Usage:       "filecache-bin backup [-raw] <snapshot path>",
+		Action: func(c *cli.Context) error {
+			if len(c.Args()) != 1 {
+				return fmt.Errorf("invalid params count")
+			} else if file == "" {
+				return fmt.Errorf("invalid file path")
+			}
+
+			cache, err := filecache.Open(file, cacheOptions()...)
+			if err != nil {
+				return err
+			}
+			defer cache.Close()
+
+			mode := filecache.SnapshotLive
+			if raw {
+				mode = filecache.SnapshotRaw
+			}
+			if err := cache.SnapshotTo(c.Args()[0], mode); err != nil {
+				return err
+			}
+			fmt.Println("OK")
+			return nil
+		},
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:        "f",
+				Destination: &file,
+			},
+			cli.BoolFlag{
+				Name:        "raw",
+				Usage:       "copy the whole file instead of only live entries",
+				Destination: &raw,
+			},
+		},
+	}
+}
+
+func cmdRestore() cli.Command {
+	var file string
+	return cli.Command{
+		Name:        "restore",
+		Description: "restore filecache file from a snapshot",
+		Usage:       "filecache-bin restore <snapshot path>",
+		Action: func(c *cli.Context) error {
+			if len(c.Args()) != 1 {
+				return fmt.Errorf("invalid params count")
+			} else if file == "" {
+				return fmt.Errorf("invalid file path")
+			}
+
+			snapshot, err := os.Open(c.Args()[0])
+			if err != nil {
+				return err
+			}
+			defer snapshot.Close()
+
+			cache, err := filecache.Open(file, cacheOptions()...)
+			if err != nil {
+				return err
+			}
+			defer cache.Close()
+
+			if err := cache.Restore(snapshot); err != nil {
+				return err
+			}
+			fmt.Println("OK")
+			return nil
+		},
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:        "f",
+				Destination: &file,
+			},
+		},
+	}
+}
+
+func cmdExport() cli.Command {
+	var file, format, output string
+	return cli.Command{
+		Name:        "export",
+		Description: "export all vals from filecache file as jsonl, csv or resp",
+		Usage:       "filecache-bin export [-format jsonl|csv|resp] [-o output]",
+		Action: func(c *cli.Context) error {
+			if file == "" {
+				return fmt.Errorf("invalid file path")
+			}
+			f, err := filecache.ParseFormat(format)
+			if err != nil {
+				return err
+			}
+
+			w := os.Stdout
+			if output != "" {
+				if w, err = os.Create(output); err != nil {
+					return err
+				}
+				defer w.Close()
+			}
+
+			return filecache.Export(filecache.New(file, cacheOptions()...), w, f)
+		},
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:        "f",
+				Destination: &file,
+			},
+			cli.StringFlag{
+				Name:        "format",
+				Value:       "jsonl",
+				Destination: &format,
+			},
+			cli.StringFlag{
+				Name:        "o",
+				Usage:       "output file, default stdout",
+				Destination: &output,
+			},
+		},
+	}
+}
+
+func cmdImport() cli.Command {
+	var file, format string
+	var ttl int
+	return cli.Command{
+		Name:        "import",
+		Description: "import vals into filecache file from jsonl, csv or resp",
+		Usage:       "filecache-bin import [-format jsonl|csv|resp] [-ttl seconds] <input or ->",
+		Action: func(c *cli.Context) error {
+			if len(c.Args()) != 1 {
+				return fmt.Errorf("invalid params count")
+			} else if file == "" {
+				return fmt.Errorf("invalid file path")
+			}
+			f, err := filecache.ParseFormat(format)
+			if err != nil {
+				return err
+			}
+
+			r := os.Stdin
+			if c.Args()[0] != "-" {
+				if r, err = os.Open(c.Args()[0]); err != nil {
+					return err
+				}
+				defer r.Close()
+			}
+
+			count, err := filecache.Import(filecache.New(file, cacheOptions()...), r, f, time.Duration(ttl)*time.Second)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("OK, %d imported\n", count)
+			return nil
+		},
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:        "f",
+				Destination: &file,
+			},
+			cli.StringFlag{
+				Name:        "format",
+				Value:       "jsonl",
+				Destination: &format,
+			},
+			cli.IntFlag{
+				Name:        "ttl",
+				Usage:       "use this ttl seconds instead of the ttl in input",
+				Destination: &ttl,
+			},
+		},
+	}
+}
+
+func cmdFsck() cli.Command {
+	var file, repair string
+	return cli.Command{
+		Name:        "fsck",
+		Description: "check filecache file, and write a repaired copy with -repair",
+		Usage:       "filecache-bin fsck [-repair output]",
+		Action: func(c *cli.Context) error {
+			if file == "" {
+				return fmt.Errorf("invalid file path")
+			}
+
+			var report *filecache.Report
+			var err error
+			if repair != "" {
+				report, err = filecache.Repair(file, repair, cacheOptions()...)
+			} else {
+				report, err = filecache.Check(file)
+			}
+			if err != nil {
+				return err
+			}
+
+			for _, p := range report.Problems {
+				fmt.Println(p.String())
+			}
+			fmt.Printf("%d blocks, %d docs, %d expired, %d problems\n", report.Blocks, report.Docs, report.Expired, len(report.Problems))
+			if !report.OK() && repair == "" {
+				return fmt.Errorf("file has problems, run with -repair to write a repaired copy")
+			}
+			return nil
+		},
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:        "f",
+				Destination: &file,
+			},
+			cli.StringFlag{
+				Name:        "repair",
+				Usage:       "write repaired file to this path",
+				Destination: &repair,
+			},
+		},
+	}
+}
+
+func cmdRekey() cli.Command {
+	var file string
+	var hashKeys bool
+	return cli.Command{
+		Name:        "rekey",
+		Description: "re-encrypt filecache file from FILECACHE_KEY to FILECACHE_NEW_KEY, empty means plaintext",
+		Usage:       "FILECACHE_KEY=<old hex> FILECACHE_NEW_KEY=<new hex> filecache-bin rekey [-hash-keys]",
+		Action: func(c *cli.Context) error {
+			if file == "" {
+				return fmt.Errorf("invalid file path")
+			}
+			oldKey, err := envKey("FILECACHE_KEY")
+			if err != nil {
+				return err
+			}
+			newKey, err := envKey("FILECACHE_NEW_KEY")
+			if err != nil {
+				return err
+			}
+
+			if err := filecache.Rekey(file, oldKey, newKey, hashKeys); err != nil {
+				return err
+			}
+			fmt.Println("OK")
+			return nil
+		},
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:        "f",
+				Destination: &file,
+			},
+			cli.BoolFlag{
+				Name:        "hash-keys",
+				Usage:       "store only the HMAC of keys in the new file",
+				Destination: &hashKeys,
+			},
+		},
+	}
+}
+
+func cmdFlush() cli.Command {
+	var file string
+	var truncate, yes bool
+	return cli.Command{
+		Name:        "flush",
+		Description: "delete all vals in filecache file, including all buckets",
+		Usage:       "filecache-bin flush [-truncate] [-y]",
+		Action: func(c *cli.Context) error {
+			if file == "" {
+				return fmt.Errorf("invalid file path")
+			}
+			if !yes {
+				fmt.Printf("delete all vals in %s? [y/N] ", file)
+				answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+				if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+					return fmt.Errorf("aborted")
+				}
+			}
+
+			cache, err := filecache.Open(file, cacheOptions()...)
+			if err != nil {
+				return err
+			}
+			defer cache.Close()
+			if err := cache.FlushAll(truncate); err != nil {
+				return err
+			}
+			fmt.Println("OK")
+			return nil
+		},
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:        "f",
+				Destination: &file,
+			},
+			cli.BoolFlag{
+				Name:        "truncate",
+				Usage:       "shrink file to one block, no other process may have the file open",
+				Destination: &truncate,
+			},
+			cli.BoolFlag{
+				Name:        "y",
+				Usage:       "do not ask for confirmation",
+				Destination: &yes,
+			},
+		},
+	}
+}
+
+func cmdStats() cli.Command {
+	var file string
+	var asJSON bool
+	return cli.Command{
+		Name:        "stats",
+		Description: "show usage of filecache file",
+		Usage:       "filecache-bin stats [-json]",
+		Action: func(c *cli.Context) error {
+			if file == "" {
+				return fmt.Errorf("invalid file path")
+			}
+			cache, err := filecache.Open(file, cacheOptions()...)
+			if err != nil {
+				return err
+			}
+			defer cache.Close()
+
+			stats := cache.Stats()
+			if asJSON {
+				return json.NewEncoder(os.Stdout).Encode(stats)
+			}
+
+			fmt.Printf("len:        %d\n", stats.Len)
+			fmt.Printf("entries:    %d live, %d stale, %d expired\n", stats.Entries, stats.Stale, stats.Expired)
+			fmt.Printf("bytes:      %d used, %d allocated, %d file\n", stats.UsedBytes, stats.AllocatedBytes, stats.FileSize)
+			fmt.Printf("blocks:     %d\n", stats.Blocks)
+			for j, fill := range stats.BlockFill {
+				fmt.Printf("  block %-3d %6.2f%%\n", j, fill*100)
+			}
+			fmt.Println("region fill:")
+			for i, n := range stats.RegionFill {
+				if i == len(stats.RegionFill)-1 {
+					fmt.Printf("  100%%      %d\n", n)
+				} else {
+					fmt.Printf("  %3d-%3d%%  %d\n", i*10, i*10+10, n)
+				}
+			}
+			return nil
+		},
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:        "f",
+				Destination: &file,
+			},
+			cli.BoolFlag{
+				Name:        "json",
+				Destination: &asJSON,
+			},
+		},
+	}
+}
+
+func cmdWatch() cli.Command {
+	var file string
+	var prefix string
+	return cli.Command{
+		Name:        "watch",
+		Description: "print changes of keys with prefix made by any process, until interrupted",
+		Usage:       "filecache-bin watch [-prefix prefix]",
+		Action: func(c *cli.Context) error {
+			if file == "" {
+				return fmt.Errorf("invalid file path")
+			}
+			cache, err := filecache.Open(file, cacheOptions()...)
+			if err != nil {
+				return err
+			}
+			defer cache.Close()
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+			events, err := cache.Watch(ctx, prefix)
+			if err != nil {
+				return err
+			}
+			for e := range events {
+				key := e.Key
+				if e.Bucket != "" {
+					key = e.Bucket + "/" + key
+				}
+				fmt.Printf("%d\t%s\t%s\n", e.Seq, e.Type, key)
+			}
+			return nil
+		},
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:        "f",
+				Destination: &file,
+			},
+			cli.StringFlag{
+				Name:        "prefix",
+				Destination: &prefix,
+			},
+		},
+	}
+}
+
 func main() {
 	app := cli.NewApp()
 	app.Name = "filecache client"
@@ -167,6 +608,15 @@ func main() {
 		cmdTTL(),
 		cmdDel(),
 		cmdRange(),
+		cmdBackup(),
+		cmdRestore(),
+		cmdExport(),
+		cmdImport(),
+		cmdFsck(),
+		cmdRekey(),
+		cmdFlush(),
+		cmdStats(),
+		cmdWatch(),
 	}
 
 	if err := app.Run(os.Args); err != nil {
@@ -0,0 +1,63 @@
+package filecache
+
+// Compact 删除过期的数据，把后面block中的数据移到前面block的空位中，最后重建bloom filter
+// 文件不会变小，其他进程可能还映射着后面的block
+func (r *CacheImpl) Compact() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return r.err
+	}
+
+	if err := r.reclaimAll(); err != nil {
+		return err
+	}
+	// 顺便修复分配表中泄漏的slot
+	if err := r.rebuildSlab(); err != nil {
+		return err
+	}
+
+	for region := 0; region < entryCount; region++ {
+		for j := 1; j < r.blocks(); j++ {
+			regionOffset := blockOffset(j) + region*entrySize
+			for offset := r.nextDoc(regionOffset, -1); offset >= 0; offset = r.nextDoc(regionOffset, offset) {
+				if !r.isUsed(offset) {
+					continue
+				}
+				docLen, err := r.docLen(offset)
+				if err != nil {
+					return err
+				}
+				to := -1
+				for k := 0; k < j && to < 0; k++ {
+					if to, err = r.alloc(k, region, docLen); err != nil {
+						return err
+					}
+				}
+				if to < 0 {
+					continue
+				}
+
+				// 先写新的位置，再删除旧的，中途退出最多留下两份相同的数据
+				// 其他进程在重建bloom filter之前也会读，新的位置要先记到bloom filter中
+				buf := make([]byte, docLen)
+				copy(buf, r.mmap[offset:offset+docLen])
+				keyLen, err := binaryInt(buf[1:3])
+				if err != nil {
+					return err
+				}
+				r.bloomAdd((to-headerSize)/bufSize, string(buf[docHeaderLength:docHeaderLength+keyLen]))
+				if err := r.writeDoc(to, buf); err != nil {
+					return err
+				}
+				if err := r.freeDoc(offset); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	r.indexReset()
+
+	return r.rebuildBloom()
+}
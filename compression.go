@@ -0,0 +1,142 @@
+package filecache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// 开启压缩之后，value压缩后和key一起放得进一个doc就可以写入，压缩前最大是MaxLengthUncompressedValue
+const MaxLengthUncompressedValue = 65536
+
+var InvalidCompressedValue = errors.New("invalid compressed value")
+
+// Compression 是value的压缩方式，记录在每个doc的flag中，不同压缩方式写入的doc可以混在一个文件中
+type Compression uint32
+
+const (
+	CompressionNone Compression = iota
+	CompressionGzip
+	CompressionSnappy
+	CompressionZstd
+)
+
+// WithCompression 长度不小于threshold的value压缩之后再写入，压缩后没有变小的不压缩
+func WithCompression(compression Compression, threshold int) Option {
+	return func(o *options) {
+		o.compression = compression
+		o.compressionThreshold = threshold
+	}
+}
+
+func (r *CacheImpl) maxLengthValue() int {
+	if r.options.compression != CompressionNone {
+		return MaxLengthUncompressedValue
+	}
+	return MaxLengthValue
+}
+
+// 返回doc的flag中压缩方式的bit，以及要写入的value
+func (r *CacheImpl) compress(val string) (byte, []byte, error) {
+	compression := r.options.compression
+	if compression == CompressionNone || len(val) < r.options.compressionThreshold {
+		return 0, []byte(val), nil
+	}
+
+	var out []byte
+	switch compression {
+	case CompressionGzip:
+		var buf bytes.Buffer
+		w, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		if err != nil {
+			return 0, nil, err
+		}
+		if _, err := io.WriteString(w, val); err != nil {
+			return 0, nil, err
+		}
+		if err := w.Close(); err != nil {
+			return 0, nil, err
+		}
+		out = buf.Bytes()
+	case CompressionSnappy:
+		out = snappy.Encode(nil, []byte(val))
+	case CompressionZstd:
+		enc, _, err := zstdCodec()
+		if err != nil {
+			return 0, nil, err
+		}
+		out = enc.EncodeAll([]byte(val), nil)
+	default:
+		return 0, []byte(val), nil
+	}
+
+	if len(out) >= len(val) {
+		out, compression = []byte(val), CompressionNone
+	}
+	atomic.AddUint64(&r.stats.uncompressedBytes, uint64(len(val)))
+	atomic.AddUint64(&r.stats.compressedBytes, uint64(len(out)))
+	return byte(compression) << 1, out, nil
+}
+
+// 按照doc flag中的压缩方式还原value
+func decompress(flag byte, val []byte) (string, error) {
+	switch Compression(flag&docCodecMask) >> 1 {
+	case CompressionNone:
+		return string(val), nil
+	case CompressionGzip:
+		rd, err := gzip.NewReader(bytes.NewReader(val))
+		if err != nil {
+			return "", InvalidCompressedValue
+		}
+		out, err := ioutil.ReadAll(io.LimitReader(rd, MaxLengthUncompressedValue+1))
+		if err != nil || len(out) > MaxLengthUncompressedValue {
+			return "", InvalidCompressedValue
+		}
+		return string(out), nil
+	case CompressionSnappy:
+		if n, err := snappy.DecodedLen(val); err != nil || n > MaxLengthUncompressedValue {
+			return "", InvalidCompressedValue
+		}
+		out, err := snappy.Decode(nil, val)
+		if err != nil {
+			return "", InvalidCompressedValue
+		}
+		return string(out), nil
+	case CompressionZstd:
+		_, dec, err := zstdCodec()
+		if err != nil {
+			return "", err
+		}
+		out, err := dec.DecodeAll(val, nil)
+		if err != nil {
+			return "", InvalidCompressedValue
+		}
+		return string(out), nil
+	}
+	return "", InvalidCompressedValue
+}
+
+var zstdOnce struct {
+	sync.Once
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+	err error
+}
+
+// value都很小，整个进程共用一个encoder和decoder，EncodeAll和DecodeAll可以并发调用
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		if zstdOnce.enc, zstdOnce.err = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1)); zstdOnce.err != nil {
+			return
+		}
+		zstdOnce.dec, zstdOnce.err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(MaxLengthUncompressedValue))
+	})
+	return zstdOnce.enc, zstdOnce.dec, zstdOnce.err
+}
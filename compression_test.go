@@ -0,0 +1,60 @@
+package filecache_test
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Chyroc/filecache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompression(t *testing.T) {
+	as := assert.New(t)
+	defer os.Remove("./test-compression")
+	os.Remove("./test-compression")
+
+	json := strings.Repeat(`{"id":123,"name":"hello world","tags":["a","b"]},`, 40) // 2000B
+	for _, compression := range []filecache.Compression{filecache.CompressionGzip, filecache.CompressionSnappy, filecache.CompressionZstd} {
+		c, err := filecache.Open("./test-compression", filecache.WithCompression(compression, 256))
+		as.Nil(err)
+
+		// 压缩之后可以超过MaxLengthValue
+		for i := 0; i < 100; i++ {
+			as.Nil(c.Set("json-"+strconv.Itoa(int(compression))+"-"+strconv.Itoa(i), json, time.Minute))
+		}
+		as.Nil(c.Set("short-"+strconv.Itoa(int(compression)), "v", time.Minute))
+		as.Equal(filecache.ValueTooLong, c.Set("too-long", strings.Repeat("v", filecache.MaxLengthUncompressedValue+1), time.Minute))
+
+		stats := c.Stats()
+		as.True(stats.CompressionRatio() > 5, "%v", stats.CompressionRatio())
+
+		v, err := c.Get("json-" + strconv.Itoa(int(compression)) + "-0")
+		as.Nil(err)
+		as.Equal(json, v)
+		as.Nil(c.Close())
+	}
+
+	// 不开启压缩也能读到压缩过的value
+	c, err := filecache.Open("./test-compression")
+	as.Nil(err)
+	for _, compression := range []filecache.Compression{filecache.CompressionGzip, filecache.CompressionSnappy, filecache.CompressionZstd} {
+		v, err := c.Get("json-" + strconv.Itoa(int(compression)) + "-99")
+		as.Nil(err)
+		as.Equal(json, v)
+		v, err = c.Get("short-" + strconv.Itoa(int(compression)))
+		as.Nil(err)
+		as.Equal("v", v)
+	}
+	as.Equal(filecache.ValueTooLong, c.Set("json", json, time.Minute))
+	kvs, err := c.Range()
+	as.Nil(err)
+	as.Len(kvs, 303)
+	as.Nil(c.Close())
+
+	report, err := filecache.Check("./test-compression")
+	as.Nil(err)
+	as.True(report.OK(), "%v", report.Problems)
+}
@@ -0,0 +1,114 @@
+package filecache
+
+import (
+	"context"
+	"time"
+)
+
+// ContextCache 和Cache一样，但是等锁和遍历文件的时候ctx结束了会返回ctx.Err()
+// 已经开始的读写（包括缺页时读文件）不能中断。Cache的方法是用context.Background()调用这些方法
+type ContextCache interface {
+	GetCtx(ctx context.Context, key string) (string, error)
+	SetCtx(ctx context.Context, key, val string, ttl time.Duration) error
+	TTLCtx(ctx context.Context, key string) (time.Duration, error)
+	ExpireCtx(ctx context.Context, key string, ttl time.Duration) error
+	DelCtx(ctx context.Context, key string) error
+	RangeCtx(ctx context.Context) ([]*KV, error)
+}
+
+// 遍历的时候每隔多少个doc检查一次ctx
+const scanCheckInterval = 256
+
+func (r *CacheImpl) GetCtx(ctx context.Context, key string) (string, error) {
+	if err := lockCtx(ctx, r.mu.RLock, r.mu.RUnlock); err != nil {
+		return "", err
+	}
+	kv, expired, err := r.getExpired(0, key)
+	r.countGet(err)
+	r.mu.RUnlock()
+
+	if expired {
+		r.lazyExpire(ctx, 0, key)
+	}
+	if err != nil {
+		return "", err
+	}
+	return kv.val, nil
+}
+
+func (r *CacheImpl) SetCtx(ctx context.Context, key, val string, ttl time.Duration) error {
+	if err := lockCtx(ctx, r.mu.Lock, r.mu.Unlock); err != nil {
+		return err
+	}
+	defer r.mu.Unlock()
+
+	return r.mutate([]*op{{kind: opSet, key: key, val: val, expiredAt: unixMs(ttl)}})
+}
+
+func (r *CacheImpl) TTLCtx(ctx context.Context, key string) (time.Duration, error) {
+	if err := lockCtx(ctx, r.mu.RLock, r.mu.RUnlock); err != nil {
+		return 0, err
+	}
+	defer r.mu.RUnlock()
+
+	kv, err := r.get(0, key)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(kv.ttl) * time.Millisecond, nil
+}
+
+func (r *CacheImpl) ExpireCtx(ctx context.Context, key string, ttl time.Duration) error {
+	if err := lockCtx(ctx, r.mu.Lock, r.mu.Unlock); err != nil {
+		return err
+	}
+	defer r.mu.Unlock()
+
+	return r.mutate([]*op{{kind: opExpire, key: key, expiredAt: unixMs(ttl)}})
+}
+
+func (r *CacheImpl) DelCtx(ctx context.Context, key string) error {
+	if err := lockCtx(ctx, r.mu.Lock, r.mu.Unlock); err != nil {
+		return err
+	}
+	defer r.mu.Unlock()
+
+	return r.mutate([]*op{{kind: opDel, key: key}})
+}
+
+func (r *CacheImpl) RangeCtx(ctx context.Context) ([]*KV, error) {
+	if err := lockCtx(ctx, r.mu.Lock, r.mu.Unlock); err != nil {
+		return nil, err
+	}
+	defer r.mu.Unlock()
+
+	return r.rangeKV(ctx, 0)
+}
+
+// 拿到锁返回nil，ctx先结束的话返回ctx.Err()，之后拿到的锁会在后台释放
+func lockCtx(ctx context.Context, lock, unlock func()) error {
+	if ctx.Done() == nil {
+		lock()
+		return nil
+	} else if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		lock()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-locked
+			unlock()
+		}()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,102 @@
+package filecache_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Chyroc/filecache"
+	"github.com/stretchr/testify/assert"
+)
+
+// 前n次Err()返回nil，之后返回context.Canceled，用来在遍历的中间结束
+type cancelAfter struct {
+	context.Context
+	n int
+}
+
+func (c *cancelAfter) Done() <-chan struct{} {
+	return make(chan struct{})
+}
+
+func (c *cancelAfter) Err() error {
+	if c.n--; c.n < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestContext(t *testing.T) {
+	as := assert.New(t)
+	defer os.Remove("./test-context")
+	os.Remove("./test-context")
+
+	c, err := filecache.Open("./test-context")
+	as.Nil(err)
+	defer c.Close()
+
+	var cache filecache.ContextCache = c
+	ctx := context.Background()
+
+	t.Run("background", func(t *testing.T) {
+		as.Nil(cache.SetCtx(ctx, "k", "v", time.Minute))
+		val, err := cache.GetCtx(ctx, "k")
+		as.Nil(err)
+		as.Equal("v", val)
+		ttl, err := cache.TTLCtx(ctx, "k")
+		as.Nil(err)
+		as.True(ttl > 0)
+		as.Nil(cache.ExpireCtx(ctx, "k", time.Hour))
+		kvs, err := cache.RangeCtx(ctx)
+		as.Nil(err)
+		as.Len(kvs, 1)
+		as.Nil(cache.DelCtx(ctx, "k"))
+		_, err = c.Get("k")
+		as.Equal(filecache.NotFound, err)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		as.Nil(c.Set("k", "v", time.Minute))
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := cache.GetCtx(ctx, "k")
+		as.Equal(context.Canceled, err)
+		as.Equal(context.Canceled, cache.SetCtx(ctx, "k", "v2", time.Minute))
+		as.Equal(context.Canceled, cache.DelCtx(ctx, "k"))
+		_, err = cache.RangeCtx(ctx)
+		as.Equal(context.Canceled, err)
+
+		val, err := c.Get("k")
+		as.Nil(err)
+		as.Equal("v", val)
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		val, err := cache.GetCtx(ctx, "k")
+		as.Nil(err)
+		as.Equal("v", val)
+
+		ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+		defer cancel()
+		_, err = cache.GetCtx(ctx, "k")
+		as.Equal(context.DeadlineExceeded, err)
+	})
+
+	t.Run("scan", func(t *testing.T) {
+		for i := 0; i < 1000; i++ {
+			as.Nil(c.Set(fmt.Sprintf("k%d", i), "v", time.Minute))
+		}
+		_, err := cache.RangeCtx(&cancelAfter{Context: ctx, n: 2})
+		as.Equal(context.Canceled, err)
+
+		// 锁已经释放了
+		kvs, err := cache.RangeCtx(ctx)
+		as.Nil(err)
+		as.Len(kvs, 1001)
+	})
+}
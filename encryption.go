@@ -0,0 +1,308 @@
+package filecache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"os"
+)
+
+var InvalidEncryptionKey = errors.New("encryption key must be at least 16 bytes")
+var EncryptionKeyRequired = errors.New("file is encrypted, encryption key required")
+
+// WrongEncryptionKey 文件是用另一个key加密的，或者文件没有加密（需要先用Rekey加密）
+var WrongEncryptionKey = errors.New("wrong encryption key")
+var DecryptFailed = errors.New("decrypt failed")
+
+// metaKeyFlags
+const (
+	keyFlagHashKeys = 1 << iota // key用HMAC hash之后再写入，原来的key加密后和value放在一起
+)
+
+// WithEncryption 使用AES-GCM加密value，key至少16个字节，用HMAC-SHA256派生出加密用的key和key-ID
+// hashKeys为true时文件中只有key的HMAC，看不到原来的key。
+// 新建文件时key-ID和hashKeys记录在header里，打开已有的文件时key-ID必须一致，hashKeys以文件中的为准
+// wal中的记录也会加密，Snapshot(SnapshotLive)和Export输出的是明文
+func WithEncryption(key []byte, hashKeys bool) Option {
+	return func(o *options) {
+		o.encryptionKey = key
+		o.hashKeys = hashKeys
+	}
+}
+
+type encryption struct {
+	id       uint64
+	aead     cipher.AEAD
+	macKey   []byte
+	hashKeys bool
+}
+
+func deriveKey(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+func newEncryption(key []byte, hashKeys bool) (*encryption, error) {
+	if len(key) < 16 {
+		return nil, InvalidEncryptionKey
+	}
+
+	block, err := aes.NewCipher(deriveKey(key, "filecache encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	id := binary.LittleEndian.Uint64(deriveKey(key, "filecache key id"))
+	if id == 0 {
+		// 0表示没有加密
+		id = 1
+	}
+
+	return &encryption{
+		id:       id,
+		aead:     aead,
+		macKey:   deriveKey(key, "filecache key hash"),
+		hashKeys: hashKeys,
+	}, nil
+}
+
+// 新建的文件记录key-ID，已有的文件检查key-ID
+func (r *CacheImpl) loadEncryption(created bool) error {
+	if created {
+		if r.options.encryptionKey == nil {
+			return nil
+		}
+		e, err := newEncryption(r.options.encryptionKey, r.options.hashKeys)
+		if err != nil {
+			return err
+		}
+		r.encryption = e
+		r.putHeaderUint64(metaKeyID, e.id)
+		if e.hashKeys {
+			r.putHeaderUint32(metaKeyFlags, keyFlagHashKeys)
+		}
+		return nil
+	}
+
+	id := r.headerUint64(metaKeyID)
+	switch {
+	case id == 0 && r.options.encryptionKey == nil:
+		return nil
+	case id == 0:
+		return WrongEncryptionKey
+	case r.options.encryptionKey == nil:
+		return EncryptionKeyRequired
+	}
+
+	e, err := newEncryption(r.options.encryptionKey, r.headerUint32(metaKeyFlags)&keyFlagHashKeys != 0)
+	if err != nil {
+		return err
+	}
+	if e.id != id {
+		return WrongEncryptionKey
+	}
+	r.encryption = e
+	return nil
+}
+
+// 文件中记录的key
+func (r *CacheImpl) storedKey(key string) string {
+	if r.encryption == nil || !r.encryption.hashKeys {
+		return key
+	}
+	mac := hmac.New(sha256.New, r.encryption.macKey)
+	mac.Write([]byte(key))
+	return string(mac.Sum(nil))
+}
+
+// nonce(12) + 密文，密文和文件中的key绑定，不能移到别的doc中
+func (e *encryption) seal(plain, additional []byte) ([]byte, error) {
+	nonce := make([]byte, e.aead.NonceSize(), e.aead.NonceSize()+len(plain)+e.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return e.aead.Seal(nonce, nonce, plain, additional), nil
+}
+
+func (e *encryption) open(data, additional []byte) ([]byte, error) {
+	if len(data) < e.aead.NonceSize() {
+		return nil, DecryptFailed
+	}
+	plain, err := e.aead.Open(nil, data[:e.aead.NonceSize()], data[e.aead.NonceSize():], additional)
+	if err != nil {
+		return nil, DecryptFailed
+	}
+	return plain, nil
+}
+
+// 返回要写入doc的value和flag，hash了key的时候原来的key也一起加密
+func (r *CacheImpl) encrypt(flag byte, storedKey, key string, val []byte) (byte, []byte, error) {
+	e := r.encryption
+	if e == nil {
+		return flag, val, nil
+	}
+
+	plain := val
+	if e.hashKeys {
+		tmp := make([]byte, binary.MaxVarintLen64)
+		plain = append(tmp[:binary.PutUvarint(tmp, uint64(len(key)))], key...)
+		plain = append(plain, val...)
+	}
+	sealed, err := e.seal(plain, []byte(storedKey))
+	if err != nil {
+		return 0, nil, err
+	}
+	return flag | docEncrypted, sealed, nil
+}
+
+// 从doc中读出原来的key和value
+func (r *CacheImpl) decodeValue(flag byte, storedKey, val []byte) (string, string, error) {
+	key, val, err := r.decryptValue(flag, storedKey, val)
+	if err != nil {
+		return "", "", err
+	}
+	s, err := decompress(flag, val)
+	if err != nil {
+		return "", "", err
+	}
+	return key, s, nil
+}
+
+// 和decodeValue一样，但是value不解压
+func (r *CacheImpl) decryptValue(flag byte, storedKey, val []byte) (string, []byte, error) {
+	key := string(storedKey)
+	if flag&docEncrypted == 0 {
+		return key, val, nil
+	}
+	e := r.encryption
+	if e == nil {
+		return "", nil, EncryptionKeyRequired
+	}
+	plain, err := e.open(val, storedKey)
+	if err != nil {
+		return "", nil, err
+	}
+	val = plain
+
+	if e.hashKeys {
+		keyLen, n := binary.Uvarint(val)
+		if n <= 0 || uint64(len(val)-n) < keyLen {
+			return "", nil, DecryptFailed
+		}
+		key = string(val[n : n+int(keyLen)])
+		val = val[n+int(keyLen):]
+	}
+	return key, val, nil
+}
+
+// 和readDoc一样，另外返回没有解压的value和它在doc flag中压缩方式的bit
+func (r *CacheImpl) readCompressed(offset int) (*kv, byte, []byte, error) {
+	kv, err := r.readDoc(offset)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	valLen, err := binaryInt(r.mmap[offset+3 : offset+5])
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	flag := r.mmap[offset]
+	valOffset := offset + docHeaderLength + len(kv.rawKey)
+	_, rawVal, err := splitExt(flag, r.mmap[valOffset:valOffset+valLen])
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	_, stored, err := r.decryptValue(flag, []byte(kv.rawKey), rawVal)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return kv, flag & docCodecMask, stored, nil
+}
+
+// Rekey 用newKey重新加密path，oldKey为nil表示path没有加密，newKey为nil表示解密成明文
+// hashKeys是新文件是否hash key，见WithEncryption。只保留没有过期的数据，每个value保持原来的压缩方式
+// 有wal的时候先回放，重写完之前一直持有wal的锁。path不能同时被其他进程打开
+func Rekey(path string, oldKey, newKey []byte, hashKeys bool) error {
+	var opts []Option
+	if oldKey != nil {
+		opts = append(opts, WithEncryption(oldKey, false))
+	}
+	if _, err := os.Stat(path + ".wal"); err == nil {
+		opts = append(opts, WithWAL(SyncAlways))
+	}
+	c, err := open(path, opts)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	defer c.Close()
+
+	// 换掉文件之后才释放锁，c关闭的时候不用再checkpoint
+	if w := c.wal; w != nil {
+		if err := w.lock(); err != nil {
+			return err
+		}
+		defer w.file.Close()
+		defer w.unlock()
+		if err := c.checkpoint(); err != nil {
+			return err
+		}
+		c.wal = nil
+	}
+
+	newOpts := c.layout.options()
+	if newKey != nil {
+		newOpts = append(newOpts, WithEncryption(newKey, hashKeys))
+	}
+
+	tmp := path + ".rekey"
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	if err := c.rekeyTo(tmp, newOpts); err != nil {
+		return err
+	}
+
+	if err := c.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// 把没有过期的数据写到path中，已经压缩的value不解压
+func (r *CacheImpl) rekeyTo(path string, opts []Option) error {
+	dst, err := open(path, opts)
+	if err != nil {
+		dst.Close()
+		return err
+	}
+	for _, o := range r.buckets() {
+		if err := dst.putBucket(o); err != nil {
+			dst.Close()
+			return err
+		}
+	}
+	err = r.walk(func(offset int) error {
+		kv, flag, stored, err := r.readCompressed(offset)
+		if err != nil {
+			return err
+		}
+		if kv.reclaimable() {
+			return nil
+		}
+		o := &op{kind: opSet, key: kv.key, expiredAt: int64(kv.expiredAt), grace: int64(kv.grace), ns: byte(kv.ns)}
+		return dst.setCompressed(o, flag, stored)
+	})
+	if err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
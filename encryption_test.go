@@ -0,0 +1,115 @@
+package filecache_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Chyroc/filecache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryption(t *testing.T) {
+	as := assert.New(t)
+	defer os.Remove("./test-encryption")
+	defer os.Remove("./test-encryption.wal")
+	os.Remove("./test-encryption")
+	os.Remove("./test-encryption.wal")
+
+	key := []byte("0123456789abcdef")
+	newKey := []byte("fedcba9876543210")
+
+	_, err := filecache.Open("./test-encryption", filecache.WithEncryption([]byte("short"), false))
+	as.Equal(filecache.InvalidEncryptionKey, err)
+
+	c, err := filecache.Open("./test-encryption", filecache.WithEncryption(key, true), filecache.WithWAL(filecache.SyncAlways))
+	as.Nil(err)
+	for i := 0; i < 100; i++ {
+		j := strconv.Itoa(i)
+		as.Nil(c.Set("session-"+j, "token-"+j, time.Minute))
+	}
+	as.Nil(c.Del("session-1"))
+
+	// 文件和wal中都看不到key和value
+	for _, file := range []string{"./test-encryption", "./test-encryption.wal"} {
+		data, err := ioutil.ReadFile(file)
+		as.Nil(err)
+		as.False(bytes.Contains(data, []byte("session-")), file)
+		as.False(bytes.Contains(data, []byte("token-")), file)
+	}
+	as.Nil(c.Close())
+
+	_, err = filecache.Open("./test-encryption")
+	as.Equal(filecache.EncryptionKeyRequired, err)
+	_, err = filecache.Open("./test-encryption", filecache.WithEncryption(newKey, true))
+	as.Equal(filecache.WrongEncryptionKey, err)
+
+	report, err := filecache.Check("./test-encryption")
+	as.Nil(err)
+	as.True(report.OK(), "%v", report.Problems)
+	as.Equal(99, report.Docs)
+
+	// 换一个key
+	as.Nil(filecache.Rekey("./test-encryption", key, newKey, true))
+	_, err = filecache.Open("./test-encryption", filecache.WithEncryption(key, true))
+	as.Equal(filecache.WrongEncryptionKey, err)
+	c, err = filecache.Open("./test-encryption", filecache.WithEncryption(newKey, false))
+	as.Nil(err)
+	v, err := c.Get("session-2")
+	as.Nil(err)
+	as.Equal("token-2", v)
+	_, err = c.Get("session-1")
+	as.Equal(filecache.NotFound, err)
+	kvs, err := c.Range()
+	as.Nil(err)
+	as.Len(kvs, 99)
+	for _, kv := range kvs {
+		as.Equal("session-"+kv.Val[len("token-"):], kv.Key)
+	}
+	as.Nil(c.Close())
+
+	// 解密成明文
+	as.Nil(filecache.Rekey("./test-encryption", newKey, nil, false))
+	_, err = filecache.Open("./test-encryption", filecache.WithEncryption(newKey, false))
+	as.Equal(filecache.WrongEncryptionKey, err)
+	c, err = filecache.Open("./test-encryption")
+	as.Nil(err)
+	v, err = c.Get("session-99")
+	as.Nil(err)
+	as.Equal("token-99", v)
+	as.Nil(c.Close())
+
+	// 没有回放的wal也会写到新文件中，压缩过的value不重新压缩
+	c, err = filecache.Open("./test-encryption", filecache.WithWAL(filecache.SyncAlways), filecache.WithCompression(filecache.CompressionGzip, 0))
+	as.Nil(err)
+	long := strings.Repeat("v", 2000)
+	as.Nil(c.Set("long", long, time.Minute))
+	// 回放的时候没有开启压缩，wal中只留下短的value
+	as.Nil(c.Checkpoint())
+	as.Nil(c.Set("wal", "v", time.Minute))
+	log, err := ioutil.ReadFile("./test-encryption.wal")
+	as.Nil(err)
+	as.Nil(c.Del("wal"))
+	as.Nil(c.Close())
+	as.Nil(ioutil.WriteFile("./test-encryption.wal", log, 0600))
+
+	as.Nil(filecache.Rekey("./test-encryption", nil, key, true))
+	data, err := ioutil.ReadFile("./test-encryption")
+	as.Nil(err)
+	as.False(bytes.Contains(data, []byte("session-")))
+	c, err = filecache.Open("./test-encryption", filecache.WithEncryption(key, false))
+	as.Nil(err)
+	v, err = c.Get("wal")
+	as.Nil(err)
+	as.Equal("v", v)
+	// 没有开启压缩，超过MaxLengthValue的value只能是原样复制过来的
+	v, err = c.Get("long")
+	as.Nil(err)
+	as.Equal(long, v)
+	as.Equal(101, c.Len())
+	as.Nil(c.Close())
+}
@@ -0,0 +1,346 @@
+package filecache
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// ExpiredEvent 过了硬过期时间被清理掉的数据，Val是最后的值
+type ExpiredEvent struct {
+	Key       string
+	Val       string
+	Bucket    string // 默认的namespace为空
+	ExpiredAt time.Time
+}
+
+// WithJanitor 每隔interval在后台清理一次过了硬过期时间的数据，不设置的话只在Range、Compact等操作中顺便清理
+func WithJanitor(interval time.Duration) Option {
+	return func(o *options) {
+		o.janitorInterval = interval
+	}
+}
+
+// WithOnExpire 数据过期被清理的时候调用fn，可以设置多个，在后台的goroutine中依次调用
+// 有进程在接收通知时（以及它退出后的expireLeaseIntervals个检查间隔内），所有进程清理过期数据时都会先把它放到header中的队列里
+// 队列满了的时候数据照常清理，不再通知，数量记在Stats.ExpireDropped中
+// fn返回之后才从队列中删除，进程在中间退出的话，下次打开时会再通知一次，所以同一个key可能收到多次
+// 多个进程都设置了fn时，同一个事件可能由多个进程通知。FlushAll、Bucket.Flush删除的数据见WithOnEvict，Rekey删除的数据不会通知
+func WithOnExpire(fn func(ExpiredEvent)) Option {
+	return func(o *options) {
+		o.onExpire = append(o.onExpire, fn)
+	}
+}
+
+// 过期通知的队列在header中修改记录的后面: head(8) + tail(8) + lease(8) + expireSlots个记录
+// head是入队的数量，tail是已经通知了的数量，每个记录是 seq(8) + 被清理的doc的完整拷贝
+// lease是接收通知的进程续期到的时间（ms），过了这个时间说明没有进程在接收，不再入队
+const expireOffset = changeOffset + 8 + changeSlots*changeEntrySize
+const expireLeaseOffset = expireOffset + 16
+const expireSlots = 256
+const expireEntrySize = 8 + docLength
+
+// 接收通知的进程每个检查间隔续期一次，续期的长度是expireLeaseIntervals个间隔
+const expireLeaseIntervals = 10
+
+func expireEntry(seq uint64) int {
+	return expireOffset + 24 + int((seq-1)%expireSlots)*expireEntrySize
+}
+
+type expiry struct {
+	mu        sync.Mutex
+	callbacks []func(ExpiredEvent)
+	ch        chan ExpiredEvent
+	started   bool
+	wake      chan struct{}
+	done      chan struct{}
+}
+
+func newExpiry() *expiry {
+	return &expiry{
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+}
+
+// 在open的最后调用
+func (r *CacheImpl) startExpiry() {
+	if len(r.options.onExpire) > 0 {
+		r.renewExpireLease()
+		r.expiry.mu.Lock()
+		r.expiry.callbacks = r.options.onExpire
+		r.startDispatch()
+		r.expiry.mu.Unlock()
+	}
+	if r.options.janitorInterval > 0 {
+		go r.janitor(r.options.janitorInterval)
+	}
+}
+
+func (r *CacheImpl) addHooks(onEvict func(EvictedEvent), onExpire func(ExpiredEvent)) {
+	if onEvict != nil {
+		r.onEvict.add(onEvict)
+	}
+	if onExpire != nil {
+		r.renewExpireLease()
+		r.expiry.mu.Lock()
+		r.expiry.callbacks = append(r.expiry.callbacks, onExpire)
+		r.startDispatch()
+		r.expiry.mu.Unlock()
+	}
+}
+
+// ExpiredEvents 返回过期通知的channel，和WithOnExpire一样，对方收到之后才从队列中删除
+// 每次调用返回的是同一个channel，cache关闭之后不会再发送，也不会关闭
+func (r *CacheImpl) ExpiredEvents() <-chan ExpiredEvent {
+	r.renewExpireLease()
+
+	r.expiry.mu.Lock()
+	defer r.expiry.mu.Unlock()
+	if r.expiry.ch == nil {
+		r.expiry.ch = make(chan ExpiredEvent)
+		r.startDispatch()
+	}
+	return r.expiry.ch
+}
+
+// 需要持有r.mu，扩容的时候mmap会重新映射
+func (r *CacheImpl) expireLeaseSlot() *uint64 {
+	return (*uint64)(unsafe.Pointer(&r.mmap[expireLeaseOffset]))
+}
+
+// 需要持有r.mu
+func (r *CacheImpl) expireNotify() bool {
+	return atomic.LoadUint64(r.expireLeaseSlot()) >= uint64(unixMs(0))
+}
+
+func (r *CacheImpl) dispatchInterval() time.Duration {
+	if r.options.janitorInterval > 0 {
+		return r.options.janitorInterval
+	}
+	return time.Second
+}
+
+// 把lease延长到expireLeaseIntervals个检查间隔之后，其他进程延长得更久的话不改
+func (r *CacheImpl) renewExpireLease() {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.err != nil {
+		return
+	}
+	slot := r.expireLeaseSlot()
+	lease := uint64(unixMs(expireLeaseIntervals * r.dispatchInterval()))
+	for {
+		old := atomic.LoadUint64(slot)
+		if old >= lease || atomic.CompareAndSwapUint64(slot, old, lease) {
+			return
+		}
+	}
+}
+
+// 需要持有r.expiry.mu
+func (r *CacheImpl) startDispatch() {
+	if r.expiry.started {
+		return
+	}
+	r.expiry.started = true
+	go r.dispatch(r.dispatchInterval())
+}
+
+func (r *CacheImpl) stopExpiry() {
+	close(r.expiry.done)
+}
+
+// 把offset上的doc放到过期通知的队列中，队列满了返回false
+func (r *CacheImpl) enqueueExpired(offset int) (bool, error) {
+	head, tail := r.headerUint64(expireOffset), r.headerUint64(expireOffset+8)
+	if head-tail >= expireSlots {
+		return false, nil
+	}
+	docLen, err := r.docLen(offset)
+	if err != nil {
+		return false, err
+	}
+
+	seq := head + 1
+	buf := make([]byte, 8+docLen)
+	binary.LittleEndian.PutUint64(buf, seq)
+	copy(buf[8:], r.mmap[offset:offset+docLen])
+	if err := r.write(expireEntry(seq), buf); err != nil {
+		return false, err
+	}
+	binary.LittleEndian.PutUint64(buf, seq)
+	if err := r.write(expireOffset, buf[:8]); err != nil {
+		return false, err
+	}
+
+	select {
+	case r.expiry.wake <- struct{}{}:
+	default:
+	}
+	return true, nil
+}
+
+// 有进程在接收过期通知时把offset上的doc放到队列中，队列满了的话只计数
+func (r *CacheImpl) notifyExpired(offset int) error {
+	if !r.expireNotify() {
+		return nil
+	}
+	ok, err := r.enqueueExpired(offset)
+	if err == nil && !ok {
+		atomic.AddUint64(&r.stats.expireDropped, 1)
+	}
+	return err
+}
+
+// set覆盖的旧数据已经过了硬过期时间的话，也算作过期
+func (r *CacheImpl) expireCopy(offset, epoch int) error {
+	if !r.expireNotify() {
+		return nil
+	}
+	ext, _, err := r.docExtHeader(offset)
+	if err != nil || ext.epoch != epoch {
+		return err
+	}
+	expiredAt, err := binaryInt(r.mmap[offset+5 : offset+docHeaderLength])
+	if err != nil || int64(expiredAt) >= unixMs(0) {
+		return err
+	}
+	return r.notifyExpired(offset)
+}
+
+// 删除所有过了硬过期时间的数据
+func (r *CacheImpl) reclaimAll() error {
+	return r.scan(func(kv *kv) error {
+		if !kv.reclaimable() {
+			return nil
+		}
+		return r.reclaim(kv)
+	})
+}
+
+func (r *CacheImpl) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.expiry.done:
+			return
+		case <-ticker.C:
+		}
+
+		r.mu.Lock()
+		if r.err == nil {
+			_ = r.reclaimAll()
+		}
+		r.mu.Unlock()
+	}
+}
+
+// get读到了过了硬过期时间的数据，有进程在接收过期通知时马上清理，不用等janitor
+// ctx结束了就不清理，留给janitor或者下一次get
+func (r *CacheImpl) lazyExpire(ctx context.Context, ns int, key string) {
+	if lockCtx(ctx, r.mu.Lock, r.mu.Unlock) != nil {
+		return
+	}
+	defer r.mu.Unlock()
+
+	if kv, err := r.find(ns, key); err == nil && kv.reclaimable() {
+		_ = r.reclaim(kv)
+	}
+}
+
+// 依次通知队列中的事件，其他进程放进来的和上次没有通知完的定期检查
+func (r *CacheImpl) dispatch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		r.renewExpireLease()
+		for {
+			e, seq, ok := r.peekExpired()
+			if !ok {
+				break
+			}
+			if e != nil && !r.deliver(e) {
+				return
+			}
+			r.ackExpired(seq)
+		}
+
+		select {
+		case <-r.expiry.done:
+			return
+		case <-ticker.C:
+		case <-r.expiry.wake:
+		}
+	}
+}
+
+// 返回队列中第一个没有通知的事件，记录无法解析时事件为nil，直接跳过
+func (r *CacheImpl) peekExpired() (*ExpiredEvent, uint64, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.err != nil {
+		return nil, 0, false
+	}
+	head, tail := r.headerUint64(expireOffset), r.headerUint64(expireOffset+8)
+	if tail >= head {
+		return nil, 0, false
+	}
+
+	seq := tail + 1
+	offset := expireEntry(seq)
+	if binary.LittleEndian.Uint64(r.mmap[offset:offset+8]) != seq {
+		return nil, seq, true
+	}
+	kv, err := r.readDoc(offset + 8)
+	if err != nil {
+		return nil, seq, true
+	}
+	e := &ExpiredEvent{
+		Key:       kv.key,
+		Val:       kv.val,
+		ExpiredAt: time.Unix(0, int64(kv.expiredAt+kv.grace)*int64(time.Millisecond)),
+	}
+	if kv.ns > 0 {
+		e.Bucket = r.bucketName(kv.ns)
+	}
+	return e, seq, true
+}
+
+// cache关闭了返回false
+func (r *CacheImpl) deliver(e *ExpiredEvent) bool {
+	r.expiry.mu.Lock()
+	callbacks, ch := r.expiry.callbacks, r.expiry.ch
+	r.expiry.mu.Unlock()
+
+	for _, fn := range callbacks {
+		fn(*e)
+	}
+	if ch != nil {
+		select {
+		case ch <- *e:
+		case <-r.expiry.done:
+			return false
+		}
+	}
+	return true
+}
+
+// 其他进程已经通知过了的话不用再改
+func (r *CacheImpl) ackExpired(seq uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil || r.headerUint64(expireOffset+8) != seq-1 {
+		return
+	}
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, seq)
+	_ = r.write(expireOffset+8, buf)
+}
@@ -0,0 +1,169 @@
+package filecache_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Chyroc/filecache"
+	"github.com/stretchr/testify/assert"
+)
+
+func readExpired(ch <-chan filecache.ExpiredEvent) (filecache.ExpiredEvent, bool) {
+	select {
+	case e := <-ch:
+		return e, true
+	case <-time.After(5 * time.Second):
+		return filecache.ExpiredEvent{}, false
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	as := assert.New(t)
+	defer os.Remove("./test-expiry")
+	os.Remove("./test-expiry")
+
+	t.Run("janitor", func(t *testing.T) {
+		events := make(chan filecache.ExpiredEvent, 10)
+		c, err := filecache.Open("./test-expiry", filecache.WithJanitor(20*time.Millisecond), filecache.WithOnExpire(func(e filecache.ExpiredEvent) {
+			events <- e
+		}))
+		as.Nil(err)
+		defer c.Close()
+
+		start := time.Now()
+		as.Nil(c.Set("k", "v", 30*time.Millisecond))
+		e, ok := readExpired(events)
+		as.True(ok)
+		as.Equal("k", e.Key)
+		as.Equal("v", e.Val)
+		as.Equal("", e.Bucket)
+		as.True(e.ExpiredAt.After(start))
+		as.Equal(0, c.Len())
+	})
+
+	t.Run("lazy", func(t *testing.T) {
+		events := make(chan filecache.ExpiredEvent, 10)
+		c, err := filecache.Open("./test-expiry", filecache.WithOnExpire(func(e filecache.ExpiredEvent) {
+			events <- e
+		}))
+		as.Nil(err)
+		defer c.Close()
+
+		b, err := c.Bucket("b")
+		as.Nil(err)
+		as.Nil(b.Set("k", "v1", 10*time.Millisecond))
+		as.Nil(c.SetWithGrace("stale", "v2", 10*time.Millisecond, time.Minute))
+		time.Sleep(20 * time.Millisecond)
+
+		// 宽限期内的不算过期
+		_, err = c.Get("stale")
+		as.Equal(filecache.NotFound, err)
+		_, err = b.Get("k")
+		as.Equal(filecache.NotFound, err)
+		e, ok := readExpired(events)
+		as.True(ok)
+		as.Equal(filecache.ExpiredEvent{Key: "k", Val: "v1", Bucket: "b", ExpiredAt: e.ExpiredAt}, e)
+		as.Equal(1, c.Len())
+		as.Nil(c.Del("stale"))
+
+		// GetCtx在ctx结束之前拿到锁的话一样马上清理
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		n := c.Len()
+		as.Nil(c.Set("k", "v2", 10*time.Millisecond))
+		time.Sleep(20 * time.Millisecond)
+		_, err = c.GetCtx(ctx, "k")
+		as.Equal(filecache.NotFound, err)
+		e, ok = readExpired(events)
+		as.True(ok)
+		as.Equal("v2", e.Val)
+		as.Equal(n, c.Len())
+	})
+
+	t.Run("overwrite", func(t *testing.T) {
+		c, err := filecache.Open("./test-expiry")
+		as.Nil(err)
+		defer c.Close()
+		ch := c.ExpiredEvents()
+
+		as.Nil(c.Set("k", "old", 10*time.Millisecond))
+		time.Sleep(20 * time.Millisecond)
+		as.Nil(c.Set("k", "new", time.Minute))
+		e, ok := readExpired(ch)
+		as.True(ok)
+		as.Equal("old", e.Val)
+		as.Nil(c.Del("k"))
+	})
+
+	t.Run("restart", func(t *testing.T) {
+		// 前面收到的事件可能在确认之前就关闭了，重新打开时会再收到一次，这里用另一个文件
+		defer os.Remove("./test-expiry-restart")
+		os.Remove("./test-expiry-restart")
+		c, err := filecache.Open("./test-expiry-restart")
+		as.Nil(err)
+		c.ExpiredEvents()
+		as.Nil(c.Close())
+
+		// 接收通知的进程刚退出，lease还没有过期，没有设置回调的进程也会放到队列中
+		c, err = filecache.Open("./test-expiry-restart")
+		as.Nil(err)
+		for i := 0; i < 300; i++ {
+			as.Nil(c.Set(fmt.Sprintf("k%d", i), "v", 10*time.Millisecond))
+		}
+		time.Sleep(20 * time.Millisecond)
+		_, err = c.Range()
+		as.Nil(err)
+		// 队列满了，剩下的不通知，照常清理
+		as.Equal(0, c.Len())
+		as.Equal(uint64(300-256), c.Stats().ExpireDropped)
+		as.Nil(c.Close())
+
+		c, err = filecache.Open("./test-expiry-restart")
+		as.Nil(err)
+		defer c.Close()
+		ch := c.ExpiredEvents()
+		seen := make(map[string]bool)
+		for i := 0; i < 256; i++ {
+			e, ok := readExpired(ch)
+			as.True(ok)
+			seen[e.Key] = true
+		}
+		as.Len(seen, 256)
+		as.Equal(0, c.Len())
+	})
+
+	t.Run("lease", func(t *testing.T) {
+		defer os.Remove("./test-expiry-lease")
+		os.Remove("./test-expiry-lease")
+		c, err := filecache.Open("./test-expiry-lease", filecache.WithJanitor(10*time.Millisecond))
+		as.Nil(err)
+		c.ExpiredEvents()
+		as.Nil(c.Close())
+
+		// 接收通知的进程退出之后lease过期，不再放到队列中
+		time.Sleep(150 * time.Millisecond)
+		c, err = filecache.Open("./test-expiry-lease")
+		as.Nil(err)
+		for i := 0; i < 1000; i++ {
+			as.Nil(c.Set(fmt.Sprintf("k%d", i), "v", 10*time.Millisecond))
+		}
+		time.Sleep(20 * time.Millisecond)
+		as.Nil(c.Compact())
+		as.Equal(0, c.Len())
+		as.Equal(uint64(0), c.Stats().ExpireDropped)
+		as.Nil(c.Close())
+
+		c, err = filecache.Open("./test-expiry-lease")
+		as.Nil(err)
+		defer c.Close()
+		ch := c.ExpiredEvents()
+		select {
+		case e := <-ch:
+			as.Fail("unexpected event", "%v", e)
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+}
@@ -0,0 +1,278 @@
+package filecache
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var UnknownFormat = errors.New("unknown format")
+var invalidRESP = errors.New("invalid resp")
+
+type Format int
+
+const (
+	FormatJSONL Format = iota // {"key":"k","value":"v","ttl_ms":1000}
+	FormatCSV                 // key,value,ttl_ms,base64
+	FormatRESP                // SET key value PX ttl_ms
+)
+
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "jsonl", "json":
+		return FormatJSONL, nil
+	case "csv":
+		return FormatCSV, nil
+	case "resp", "redis":
+		return FormatRESP, nil
+	}
+	return 0, UnknownFormat
+}
+
+// 不是utf8的key或者value，jsonl和csv中会用base64编码，resp本身就支持二进制
+type record struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	TTL    int64  `json:"ttl_ms"`
+	Base64 bool   `json:"base64,omitempty"`
+}
+
+func newRecord(kv *KV) *record {
+	rec := &record{Key: kv.Key, Value: kv.Val, TTL: int64(kv.TTL / time.Millisecond)}
+	if !utf8.ValidString(kv.Key) || !utf8.ValidString(kv.Val) {
+		rec.Key = base64.StdEncoding.EncodeToString([]byte(kv.Key))
+		rec.Value = base64.StdEncoding.EncodeToString([]byte(kv.Val))
+		rec.Base64 = true
+	}
+	return rec
+}
+
+func (rec *record) decode() error {
+	if !rec.Base64 {
+		return nil
+	}
+	key, err := base64.StdEncoding.DecodeString(rec.Key)
+	if err != nil {
+		return err
+	}
+	val, err := base64.StdEncoding.DecodeString(rec.Value)
+	if err != nil {
+		return err
+	}
+	rec.Key, rec.Value, rec.Base64 = string(key), string(val), false
+	return nil
+}
+
+// Export 把所有没有过期的数据按照format写到w
+func Export(c Cache, w io.Writer, format Format) error {
+	all, err := c.Range()
+	if err != nil {
+		return err
+	}
+	var kvs []*KV
+	for _, kv := range all {
+		if kv.TTL > 0 { // 马上就过期的不导出
+			kvs = append(kvs, kv)
+		}
+	}
+
+	switch format {
+	case FormatJSONL:
+		enc := json.NewEncoder(w)
+		for _, kv := range kvs {
+			if err := enc.Encode(newRecord(kv)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write([]string{"key", "value", "ttl_ms", "base64"}); err != nil {
+			return err
+		}
+		for _, kv := range kvs {
+			rec := newRecord(kv)
+			if err := cw.Write([]string{rec.Key, rec.Value, strconv.FormatInt(rec.TTL, 10), strconv.FormatBool(rec.Base64)}); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	case FormatRESP:
+		bw := bufio.NewWriter(w)
+		for _, kv := range kvs {
+			writeRESPArray(bw, "SET", kv.Key, kv.Val, "PX", strconv.FormatInt(int64(kv.TTL/time.Millisecond), 10))
+		}
+		return bw.Flush()
+	}
+
+	return UnknownFormat
+}
+
+// Import 从r中按照format读取数据写到c中，返回写入的条数
+// ttl不为0的时候忽略数据中的ttl，全部使用ttl，否则使用数据中的ttl
+func Import(c Cache, r io.Reader, format Format, ttl time.Duration) (int, error) {
+	var next func() (*record, error)
+
+	switch format {
+	case FormatJSONL:
+		dec := json.NewDecoder(r)
+		next = func() (*record, error) {
+			rec := new(record)
+			if err := dec.Decode(rec); err != nil {
+				return nil, err
+			}
+			return rec, nil
+		}
+	case FormatCSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = -1
+		header := true
+		next = func() (*record, error) {
+			for {
+				line, err := cr.Read()
+				if err != nil {
+					return nil, err
+				}
+				if header && len(line) > 1 && line[0] == "key" && line[1] == "value" {
+					header = false
+					continue
+				}
+				header = false
+				return parseCSVRecord(line)
+			}
+		}
+	case FormatRESP:
+		br := bufio.NewReader(r)
+		next = func() (*record, error) {
+			args, err := readRESPArray(br)
+			if err != nil {
+				return nil, err
+			}
+			return parseRESPSet(args)
+		}
+	default:
+		return 0, UnknownFormat
+	}
+
+	count := 0
+	for {
+		rec, err := next()
+		if err == io.EOF {
+			return count, nil
+		} else if err != nil {
+			return count, fmt.Errorf("record %d: %s", count+1, err)
+		}
+		if err := rec.decode(); err != nil {
+			return count, fmt.Errorf("record %d: %s", count+1, err)
+		}
+
+		recTTL := time.Duration(rec.TTL) * time.Millisecond
+		if ttl != 0 {
+			recTTL = ttl
+		} else if recTTL <= 0 {
+			return count, fmt.Errorf("record %d: missing ttl", count+1)
+		}
+
+		if err := c.Set(rec.Key, rec.Value, recTTL); err != nil {
+			return count, fmt.Errorf("record %d: %s", count+1, err)
+		}
+		count++
+	}
+}
+
+func parseCSVRecord(line []string) (*record, error) {
+	if len(line) < 2 {
+		return nil, errors.New("invalid csv record")
+	}
+	rec := &record{Key: line[0], Value: line[1]}
+	if len(line) > 2 && line[2] != "" {
+		ttl, err := strconv.ParseInt(line[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		rec.TTL = ttl
+	}
+	if len(line) > 3 && line[3] != "" {
+		b, err := strconv.ParseBool(line[3])
+		if err != nil {
+			return nil, err
+		}
+		rec.Base64 = b
+	}
+	return rec, nil
+}
+
+// 只支持 SET key value [EX seconds|PX milliseconds]
+func parseRESPSet(args []string) (*record, error) {
+	if len(args) < 3 || strings.ToUpper(args[0]) != "SET" {
+		return nil, errors.New("unsupported command")
+	}
+	rec := &record{Key: args[1], Value: args[2]}
+	for i := 3; i+1 < len(args); i += 2 {
+		n, err := strconv.ParseInt(args[i+1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		switch strings.ToUpper(args[i]) {
+		case "EX":
+			rec.TTL = n * 1000
+		case "PX":
+			rec.TTL = n
+		default:
+			return nil, fmt.Errorf("unsupported option %s", args[i])
+		}
+	}
+	return rec, nil
+}
+
+func writeRESPArray(w *bufio.Writer, args ...string) {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+}
+
+func readRESPArray(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF && line == "" {
+			return nil, io.EOF
+		}
+		return nil, invalidRESP
+	}
+	if len(line) < 3 || line[0] != '*' {
+		return nil, invalidRESP
+	}
+	count, err := strconv.Atoi(strings.TrimRight(line[1:], "\r\n"))
+	if err != nil || count < 0 {
+		return nil, invalidRESP
+	}
+
+	args := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil || len(line) < 3 || line[0] != '$' {
+			return nil, invalidRESP
+		}
+		length, err := strconv.Atoi(strings.TrimRight(line[1:], "\r\n"))
+		if err != nil || length < 0 {
+			return nil, invalidRESP
+		}
+		buf := make([]byte, length+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, invalidRESP
+		}
+		args = append(args, string(buf[:length]))
+	}
+
+	return args, nil
+}
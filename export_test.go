@@ -0,0 +1,74 @@
+package filecache_test
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Chyroc/filecache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportImport(t *testing.T) {
+	as := assert.New(t)
+	defer os.Remove("./test-export")
+	defer os.Remove("./test-import")
+
+	os.Remove("./test-export")
+	os.Remove("./test-import")
+	src := filecache.New("./test-export")
+	as.Nil(src.Set("a", "1", time.Minute))
+	as.Nil(src.Set("b", "x,\"y\"\nz", time.Minute))
+	as.Nil(src.Set("bin", "\xff\x00\xfe", time.Hour))
+
+	for _, format := range []string{"jsonl", "csv", "resp"} {
+		t.Run(format, func(t *testing.T) {
+			f, err := filecache.ParseFormat(format)
+			as.Nil(err)
+
+			buf := new(bytes.Buffer)
+			as.Nil(filecache.Export(src, buf, f))
+
+			os.Remove("./test-import")
+			dst := filecache.New("./test-import")
+			count, err := filecache.Import(dst, buf, f, 0)
+			as.Nil(err)
+			as.Equal(3, count)
+
+			for k, v := range map[string]string{"a": "1", "b": "x,\"y\"\nz", "bin": "\xff\x00\xfe"} {
+				val, err := dst.Get(k)
+				as.Nil(err)
+				as.Equal(v, val)
+			}
+			ttl, err := dst.TTL("bin")
+			as.Nil(err)
+			as.True(ttl > time.Minute && ttl <= time.Hour)
+		})
+	}
+
+	t.Run("override ttl", func(t *testing.T) {
+		os.Remove("./test-import")
+		dst := filecache.New("./test-import")
+		count, err := filecache.Import(dst, strings.NewReader(`{"key":"k","value":"v"}`+"\n"), filecache.FormatJSONL, time.Second)
+		as.Nil(err)
+		as.Equal(1, count)
+
+		ttl, err := dst.TTL("k")
+		as.Nil(err)
+		as.True(ttl <= time.Second)
+	})
+
+	t.Run("missing ttl", func(t *testing.T) {
+		os.Remove("./test-import")
+		dst := filecache.New("./test-import")
+		_, err := filecache.Import(dst, strings.NewReader("*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n"), filecache.FormatRESP, 0)
+		as.NotNil(err)
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		_, err := filecache.ParseFormat("xml")
+		as.Equal(filecache.UnknownFormat, err)
+	})
+}
@@ -0,0 +1,81 @@
+package filecache
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+// doc的扩展头，flag中有docExt时放在value的前面，算在val_len里
+// 结构是 fields(1) + fields中每个bit对应的字段(uvarint)，按bit从低到高排列
+// 扩展头在加密的外面，和expiredAt一样是明文
+const (
+	extGrace     = 1 << iota // 宽限期(ms)，见stale.go
+	extNamespace             // bucket的id，见bucket.go
+	extEpoch                 // 写入时header中的epoch，见flush.go
+)
+
+type extHeader struct {
+	grace int
+	ns    int
+	epoch int
+}
+
+// 返回加上扩展头之后的flag和value，没有需要记录的字段时不加
+func (e extHeader) wrap(flag byte, val []byte) (byte, []byte) {
+	var fields byte
+	buf := make([]byte, 1, 1+3*binary.MaxVarintLen64+len(val))
+	tmp := make([]byte, binary.MaxVarintLen64)
+	if e.grace > 0 {
+		fields |= extGrace
+		buf = append(buf, tmp[:binary.PutUvarint(tmp, uint64(e.grace))]...)
+	}
+	if e.ns > 0 {
+		fields |= extNamespace
+		buf = append(buf, tmp[:binary.PutUvarint(tmp, uint64(e.ns))]...)
+	}
+	if e.epoch > 0 {
+		fields |= extEpoch
+		buf = append(buf, tmp[:binary.PutUvarint(tmp, uint64(e.epoch))]...)
+	}
+	if fields == 0 {
+		return flag, val
+	}
+	buf[0] = fields
+	return flag | docExt, append(buf, val...)
+}
+
+func splitExt(flag byte, val []byte) (extHeader, []byte, error) {
+	var e extHeader
+	if flag&docExt == 0 {
+		return e, val, nil
+	}
+	if len(val) == 0 || val[0] == 0 || val[0]&^(extGrace|extNamespace|extEpoch) != 0 {
+		return e, nil, InvalidFileFormat
+	}
+	fields := val[0]
+	val = val[1:]
+
+	if fields&extGrace != 0 {
+		grace, n := binary.Uvarint(val)
+		if n <= 0 || grace == 0 || grace > uint64(maxExpireRange/time.Millisecond) {
+			return e, nil, InvalidFileFormat
+		}
+		e.grace, val = int(grace), val[n:]
+	}
+	if fields&extNamespace != 0 {
+		ns, n := binary.Uvarint(val)
+		if n <= 0 || ns == 0 || ns >= maxBuckets {
+			return e, nil, InvalidFileFormat
+		}
+		e.ns, val = int(ns), val[n:]
+	}
+	if fields&extEpoch != 0 {
+		epoch, n := binary.Uvarint(val)
+		if n <= 0 || epoch == 0 || epoch > math.MaxUint32 {
+			return e, nil, InvalidFileFormat
+		}
+		e.epoch, val = int(epoch), val[n:]
+	}
+	return e, val, nil
+}
@@ -0,0 +1,155 @@
+package filecache
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+)
+
+// EvictedEvent FlushAll、Bucket.Flush删除的数据，或者TieredCache超过容量从L1中淘汰的数据
+type EvictedEvent struct {
+	Key    string
+	Val    string
+	Bucket string // 默认的namespace为空
+}
+
+// WithOnEvict FlushAll、Bucket.Flush之后对每个被删除的、还没有过期的数据调用fn，可以设置多个
+// 在调用FlushAll的goroutine中释放锁之后依次调用，只通知本进程的清空，其他进程的清空见Watch的EventEvict
+// 设置了fn的时候FlushAll要在清空之前遍历一次文件
+func WithOnEvict(fn func(EvictedEvent)) Option {
+	return func(o *options) {
+		o.onEvict = append(o.onEvict, fn)
+	}
+}
+
+type evictHooks struct {
+	mu        sync.Mutex
+	callbacks []func(EvictedEvent)
+}
+
+func (h *evictHooks) add(fn func(EvictedEvent)) {
+	h.mu.Lock()
+	h.callbacks = append(h.callbacks, fn)
+	h.mu.Unlock()
+}
+
+func (h *evictHooks) empty() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.callbacks) == 0
+}
+
+// 不能持有锁，fn中可能会再操作cache
+func (h *evictHooks) notify(events []EvictedEvent) {
+	h.mu.Lock()
+	callbacks := h.callbacks
+	h.mu.Unlock()
+
+	for _, e := range events {
+		for _, fn := range callbacks {
+			fn(e)
+		}
+	}
+}
+
+// FlushAll 删除所有的数据，包括所有bucket中的，bucket本身和quota保留
+// 只需要把header中的epoch加1，之前写入的doc都会失效，之后在Range、Compact、Set同一个key的时候清理
+// truncate为true时把文件缩小到一个block并清空，其他进程还映射着后面的block时会出错，只能在没有其他进程打开文件的时候使用
+func (r *CacheImpl) FlushAll(truncate bool) error {
+	evicted, err := r.flushAll(truncate)
+	if err != nil {
+		return err
+	}
+	r.onEvict.notify(evicted)
+	return nil
+}
+
+func (r *CacheImpl) flushAll(truncate bool) ([]EvictedEvent, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	// 回放wal时不会再写回之前的数据，清空完之前其他进程不能写wal
+	if r.wal != nil {
+		if err := r.wal.lock(); err != nil {
+			return nil, err
+		}
+		defer r.wal.unlock()
+		if err := r.checkpoint(); err != nil {
+			return nil, err
+		}
+	}
+	evicted := r.evictedDocs(-1)
+	atomic.AddUint64(&r.stats.evictions, uint64(r.length()))
+	if truncate {
+		if err := r.truncate(); err != nil {
+			return nil, err
+		}
+	}
+
+	// bloom filter中只有失效的key，清空之后查询不用再扫描
+	zeroBytes(r.mmap[bloomOffset : bloomOffset+bloomSize*bufCount])
+	for ns := 0; ns < maxBuckets; ns++ {
+		zeroBytes(r.mmap[bucketEntry(ns)+bucketKeys : bucketEntry(ns)+bucketEntrySize])
+	}
+	r.indexReset()
+
+	// 通过write修改，其他进程根据seq知道文件变了
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, uint32(r.epoch()+1))
+	if err := r.write(metaEpoch, buf); err != nil {
+		return nil, err
+	}
+	return evicted, r.logChange(EventEvict, 0, "")
+}
+
+// 有OnEvict的时候读出ns中（ns < 0时是所有bucket中）没有失效的数据，需要在删除之前调用
+func (r *CacheImpl) evictedDocs(ns int) []EvictedEvent {
+	if r.onEvict.empty() {
+		return nil
+	}
+	var evicted []EvictedEvent
+	_ = r.walk(func(offset int) error {
+		// 解析不了的数据不影响清空，不通知
+		kv, err := r.readDoc(offset)
+		if err != nil || kv.reclaimable() || ns >= 0 && kv.ns != ns {
+			return nil
+		}
+		e := EvictedEvent{Key: kv.key, Val: kv.val}
+		if kv.ns > 0 {
+			e.Bucket = r.bucketName(kv.ns)
+		}
+		evicted = append(evicted, e)
+		return nil
+	})
+	return evicted
+}
+
+func (r *CacheImpl) epoch() int {
+	return int(r.headerUint32(metaEpoch))
+}
+
+// 文件缩小到一个block，slab分配表也要清空
+func (r *CacheImpl) truncate() error {
+	if r.err = r.mmap.Unmap(); r.err != nil {
+		return r.err
+	}
+	r.mmap = nil
+	if r.err = r.file.Truncate(headerSize); r.err != nil {
+		return r.err
+	}
+	if err := r.fileExpansion(); err != nil {
+		return err
+	}
+
+	zeroBytes(r.mmap[slabOffset : slabOffset+slabEntrySize*entryCount*bufCount])
+	return nil
+}
+
+func zeroBytes(buf []byte) {
+	for i := range buf {
+		buf[i] = 0
+	}
+}
@@ -0,0 +1,179 @@
+package filecache_test
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Chyroc/filecache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlushAll(t *testing.T) {
+	as := assert.New(t)
+	defer os.Remove("./test-flush")
+
+	for _, opts := range [][]filecache.Option{nil, {filecache.WithIndex()}, {filecache.WithAllocator(filecache.AllocSlab)}} {
+		os.Remove("./test-flush")
+		c, err := filecache.Open("./test-flush", opts...)
+		as.Nil(err)
+		other, err := filecache.Open("./test-flush", opts...)
+		as.Nil(err)
+
+		b, err := c.Bucket("b")
+		as.Nil(err)
+		as.Nil(c.Set("k", "v", time.Minute))
+		as.Nil(c.SetWithGrace("stale", "v", time.Millisecond, time.Minute))
+		as.Nil(b.Set("k", "v", time.Minute))
+		time.Sleep(5 * time.Millisecond)
+
+		as.Nil(c.FlushAll(false))
+
+		_, err = c.Get("k")
+		as.Equal(filecache.NotFound, err)
+		_, err = other.Get("k")
+		as.Equal(filecache.NotFound, err)
+		_, err = b.Get("k")
+		as.Equal(filecache.NotFound, err)
+		_, _, err = c.GetStale("stale")
+		as.Equal(filecache.NotFound, err)
+		v, err := c.GetOrLoad("stale", time.Minute, func() (string, error) {
+			return "loaded", nil
+		}, filecache.WithStaleWhileRevalidate(time.Hour))
+		as.Nil(err)
+		as.Equal("loaded", v)
+
+		stats, err := b.Stats()
+		as.Nil(err)
+		as.Equal(int64(0), stats.Keys)
+
+		// 之后写入的数据正常读写
+		as.Nil(b.Set("k", "v2", time.Minute))
+		v, err = b.Get("k")
+		as.Nil(err)
+		as.Equal("v2", v)
+		kvs, err := c.Range()
+		as.Nil(err)
+		as.Len(kvs, 1)
+
+		report, err := filecache.Check("./test-flush")
+		as.Nil(err)
+		as.True(report.OK(), "%v", report.Problems)
+
+		as.Nil(other.Close())
+		as.Nil(c.Close())
+
+		c, err = filecache.Open("./test-flush", opts...)
+		as.Nil(err)
+		_, err = c.Get("k")
+		as.Equal(filecache.NotFound, err)
+		b, err = c.Bucket("b")
+		as.Nil(err)
+		v, err = b.Get("k")
+		as.Nil(err)
+		as.Equal("v2", v)
+		stats, err = b.Stats()
+		as.Nil(err)
+		as.Equal(int64(1), stats.Keys)
+		as.Nil(c.Close())
+	}
+
+	t.Run("truncate", func(t *testing.T) {
+		os.Remove("./test-flush")
+		c, err := filecache.Open("./test-flush")
+		as.Nil(err)
+		defer c.Close()
+
+		for i := 0; i < 5000; i++ {
+			as.Nil(c.Set(fmt.Sprintf("key-%d", i), "v", time.Minute))
+		}
+		fi, err := os.Stat("./test-flush")
+		as.Nil(err)
+		as.True(fi.Size() > 1048576+5242880)
+
+		as.Nil(c.FlushAll(true))
+		fi, err = os.Stat("./test-flush")
+		as.Nil(err)
+		as.Equal(int64(1048576+5242880), fi.Size())
+
+		_, err = c.Get("key-1")
+		as.Equal(filecache.NotFound, err)
+		as.Nil(c.Set("key-1", "v2", time.Minute))
+		v, err := c.Get("key-1")
+		as.Nil(err)
+		as.Equal("v2", v)
+
+		report, err := filecache.Check("./test-flush")
+		as.Nil(err)
+		as.True(report.OK(), "%v", report.Problems)
+		as.Equal(1, report.Docs)
+	})
+
+	t.Run("max length value", func(t *testing.T) {
+		os.Remove("./test-flush")
+		c, err := filecache.Open("./test-flush")
+		as.Nil(err)
+		defer c.Close()
+		b, err := c.Bucket("b")
+		as.Nil(err)
+
+		// FlushAll之后每个doc都有记录epoch的扩展头，MaxLengthValue的value还是可以写入
+		val := strings.Repeat("v", filecache.MaxLengthValue)
+		as.Nil(c.Set("k", val, time.Minute))
+		as.Nil(c.FlushAll(false))
+		as.Nil(c.Set("k", val, time.Minute))
+		as.Nil(c.SetWithGrace("grace", val, time.Minute, time.Hour))
+		as.Nil(b.Set("k", val, time.Minute))
+		v, err := c.Get("k")
+		as.Nil(err)
+		as.Equal(val, v)
+		v, err = b.Get("k")
+		as.Nil(err)
+		as.Equal(val, v)
+		as.Equal(filecache.ValueTooLong, c.Set("k", val+"v", time.Minute))
+
+		report, err := filecache.Check("./test-flush")
+		as.Nil(err)
+		as.True(report.OK(), "%v", report.Problems)
+	})
+
+	t.Run("refill", func(t *testing.T) {
+		// 写满文件，返回写入的数量
+		val := strings.Repeat("v", 1000)
+		fill := func(c *filecache.CacheImpl, prefix string) int {
+			for n := 0; ; n++ {
+				if err := c.Set(fmt.Sprintf("%s-%d", prefix, n), val, time.Minute); err != nil {
+					as.Equal(filecache.FileSizeTooLarge, err)
+					return n
+				}
+			}
+		}
+
+		for _, opts := range [][]filecache.Option{nil, {filecache.WithAllocator(filecache.AllocSlab)}} {
+			os.Remove("./test-flush")
+			c, err := filecache.Open("./test-flush", opts...)
+			as.Nil(err)
+
+			n := fill(c, "key")
+			as.Nil(c.FlushAll(false))
+			as.Equal(0, c.Len())
+
+			// FlushAll之前写入的doc的位置可以重新使用，key不同，分布在region中的情况会有一点差别
+			m := fill(c, "new")
+			as.True(m > n*99/100, "%d %d", n, m)
+			as.Equal(m, c.Len())
+			v, err := c.Get(fmt.Sprintf("new-%d", m-1))
+			as.Nil(err)
+			as.Equal(val, v)
+			_, err = c.Get("key-1")
+			as.Equal(filecache.NotFound, err)
+
+			report, err := filecache.Check("./test-flush")
+			as.Nil(err)
+			as.True(report.OK(), "%v", report.Problems)
+			as.Nil(c.Close())
+		}
+	})
+}
@@ -0,0 +1,236 @@
+package filecache
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"hash/fnv"
+	"math/bits"
+
+	"github.com/huichen/murmur"
+)
+
+// Hasher 决定key落在哪个region，新建文件时记录在header里，之后以文件中的为准
+// 除了murmur3，其他的hash都会使用新建文件时随机生成的seed，外部没办法构造出落在同一个region的key
+type Hasher uint32
+
+const (
+	HasherMurmur3 Hasher = iota // 没有seed，和旧版本的文件兼容
+	HasherXXHash
+	HasherFNV
+	HasherSipHash
+)
+
+// WithHasher 新建文件时使用的hash，打开已有的文件时使用文件中记录的
+func WithHasher(hasher Hasher) Option {
+	return func(o *options) {
+		o.hasher = hasher
+	}
+}
+
+// 决定key放在哪里的参数，都记录在header中
+type layout struct {
+	hasher    Hasher
+	seed      [16]byte
+	placement Placement
+	allocator Allocator
+}
+
+func newLayout(o *options) (layout, error) {
+	l := layout{hasher: o.hasher, placement: o.placement, allocator: o.allocator}
+	if l.hasher != HasherMurmur3 {
+		if _, err := rand.Read(l.seed[:]); err != nil {
+			return l, err
+		}
+	}
+	return l, nil
+}
+
+func readLayout(header []byte) layout {
+	l := layout{
+		hasher:    Hasher(binary.LittleEndian.Uint32(header[metaHasher:])),
+		placement: Placement(binary.LittleEndian.Uint32(header[metaPlacement:])),
+		allocator: Allocator(binary.LittleEndian.Uint32(header[metaAllocator:])),
+	}
+	copy(l.seed[:], header[metaHashSeed:metaHashSeed+len(l.seed)])
+	return l
+}
+
+func (l *layout) write(header []byte) {
+	binary.LittleEndian.PutUint32(header[metaHasher:], uint32(l.hasher))
+	binary.LittleEndian.PutUint32(header[metaPlacement:], uint32(l.placement))
+	binary.LittleEndian.PutUint32(header[metaAllocator:], uint32(l.allocator))
+	copy(header[metaHashSeed:metaHashSeed+len(l.seed)], l.seed[:])
+}
+
+// 用同样的layout新建文件
+func (l *layout) options() []Option {
+	return []Option{WithHasher(l.hasher), WithPlacement(l.placement), WithAllocator(l.allocator)}
+}
+
+func (l *layout) valid() bool {
+	return l.hasher <= HasherSipHash && l.placement <= PlacementTwoChoice && l.allocator <= AllocSlab
+}
+
+func (l *layout) hash(key string) uint64 {
+	switch l.hasher {
+	case HasherXXHash:
+		return xxhash64([]byte(key), binary.LittleEndian.Uint64(l.seed[:8]))
+	case HasherFNV:
+		h := fnv.New64a()
+		h.Write(l.seed[:8])
+		h.Write([]byte(key))
+		return fmix64(h.Sum64())
+	case HasherSipHash:
+		return siphash([]byte(key), l.seed)
+	}
+	return uint64(murmur.Murmur3([]byte(key)))
+}
+
+func (l *layout) regions(key string) []int {
+	h := l.hash(key)
+	region := int(h % uint64(entryCount))
+	if l.placement != PlacementTwoChoice {
+		return []int{region}
+	}
+
+	var second int
+	if l.hasher == HasherMurmur3 {
+		// murmur3只有32位
+		second = int(keyHash(key) % uint64(entryCount))
+	} else {
+		second = int((h >> 32) % uint64(entryCount))
+	}
+	if second == region {
+		second = (region + 1) % entryCount
+	}
+	return []int{region, second}
+}
+
+// murmur3的finalizer。FNV-1a结果的低位只由状态的低位和key决定，seed的影响很小，取模之前要先把高位混合进来
+func fmix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMergeRound(acc, val uint64) uint64 {
+	acc ^= xxRound(0, val)
+	return acc*xxPrime1 + xxPrime4
+}
+
+// XXH64
+func xxhash64(b []byte, seed uint64) uint64 {
+	n := len(b)
+	var h uint64
+
+	if n >= 32 {
+		v1 := seed + xxPrime1 + xxPrime2
+		v2 := seed + xxPrime2
+		v3 := seed
+		v4 := seed - xxPrime1
+		for ; len(b) >= 32; b = b[32:] {
+			v1 = xxRound(v1, binary.LittleEndian.Uint64(b[0:8]))
+			v2 = xxRound(v2, binary.LittleEndian.Uint64(b[8:16]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint64(b[16:24]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint64(b[24:32]))
+		}
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) + bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = xxMergeRound(h, v1)
+		h = xxMergeRound(h, v2)
+		h = xxMergeRound(h, v3)
+		h = xxMergeRound(h, v4)
+	} else {
+		h = seed + xxPrime5
+	}
+
+	h += uint64(n)
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(b[:8]))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b[:4])) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		b = b[4:]
+	}
+	for ; len(b) > 0; b = b[1:] {
+		h ^= uint64(b[0]) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
+
+// SipHash-2-4
+func siphash(b []byte, key [16]byte) uint64 {
+	k0 := binary.LittleEndian.Uint64(key[0:8])
+	k1 := binary.LittleEndian.Uint64(key[8:16])
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13)
+		v1 ^= v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16)
+		v3 ^= v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21)
+		v3 ^= v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17)
+		v1 ^= v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+
+	n := len(b)
+	for ; len(b) >= 8; b = b[8:] {
+		m := binary.LittleEndian.Uint64(b[:8])
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+	}
+
+	last := uint64(n) << 56
+	for i := len(b) - 1; i >= 0; i-- {
+		last |= uint64(b[i]) << (8 * uint(i))
+	}
+	v3 ^= last
+	round()
+	round()
+	v0 ^= last
+
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+	return v0 ^ v1 ^ v2 ^ v3
+}
@@ -0,0 +1,87 @@
+package filecache_test
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Chyroc/filecache"
+	"github.com/huichen/murmur"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHasher(t *testing.T) {
+	as := assert.New(t)
+
+	for _, h := range []struct {
+		name   string
+		hasher filecache.Hasher
+	}{
+		{"murmur3", filecache.HasherMurmur3},
+		{"xxhash", filecache.HasherXXHash},
+		{"fnv", filecache.HasherFNV},
+		{"siphash", filecache.HasherSipHash},
+	} {
+		t.Run(h.name, func(t *testing.T) {
+			file := "./test-hasher-" + h.name
+			defer os.Remove(file)
+			os.Remove(file)
+
+			c, err := filecache.Open(file, filecache.WithHasher(h.hasher), filecache.WithPlacement(filecache.PlacementTwoChoice))
+			as.Nil(err)
+			for i := 0; i < 1000; i++ {
+				j := strconv.Itoa(i)
+				as.Nil(c.Set(j, j, time.Minute))
+			}
+			as.Nil(c.Close())
+
+			// 以文件中记录的为准
+			c, err = filecache.Open(file, filecache.WithHasher(filecache.HasherMurmur3))
+			as.Nil(err)
+			for i := 0; i < 1000; i++ {
+				j := strconv.Itoa(i)
+				v, err := c.Get(j)
+				as.Nil(err)
+				as.Equal(j, v)
+			}
+			as.Nil(c.Close())
+
+			report, err := filecache.Check(file)
+			as.Nil(err)
+			as.True(report.OK())
+		})
+	}
+
+	t.Run("collision flooding", func(t *testing.T) {
+		// 在murmur3下都落在region 0的key
+		var keys []string
+		for i := 0; len(keys) < 9; i++ {
+			k := strconv.Itoa(i)
+			if murmur.Murmur3([]byte(k))%512 == 0 {
+				keys = append(keys, k)
+			}
+		}
+
+		size := func(hasher filecache.Hasher) int64 {
+			file := "./test-hasher-flooding"
+			defer os.Remove(file)
+			os.Remove(file)
+
+			c, err := filecache.Open(file, filecache.WithHasher(hasher))
+			as.Nil(err)
+			defer c.Close()
+			for _, k := range keys {
+				as.Nil(c.Set(k, k, time.Minute))
+			}
+			fi, err := os.Stat(file)
+			as.Nil(err)
+			return fi.Size()
+		}
+
+		// 一个region只有8个doc，第9个key需要扩容
+		as.Equal(int64(1048576+5242880*2), size(filecache.HasherMurmur3))
+		as.Equal(int64(1048576+5242880), size(filecache.HasherSipHash))
+		as.Equal(int64(1048576+5242880), size(filecache.HasherFNV))
+	})
+}
@@ -0,0 +1,121 @@
+package filecache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+var InvalidFileFormat = errors.New("invalid file format")
+
+// 文件结构：header(1M) + block * n (每个block 5M)
+// header的第一个4K是meta，后面依次是各个功能使用的区域，未使用的部分保留
+// meta(4K) | journal(128K) | bloom(8K * 20) | slab分配表(6K * 20) | 加载锁(8K) | bucket表(24K) | 修改记录(256K) | 过期通知(322K) | 保留
+const headerSize = 1048576
+const headerMagic = "FILECACH"
+const headerVersion = 1
+
+// meta区域里各字段的offset
+const (
+	metaMagic        = 0  // 8
+	metaVersion      = 8  // 4
+	metaJournalState = 12 // 1
+	metaJournalLen   = 16 // 4
+	metaFlags        = 20 // 4
+	metaSeq          = 24 // 8，每次修改数据区都会加1
+	metaPlacement    = 32 // 4
+	metaHasher       = 36 // 4
+	metaHashSeed     = 40 // 16
+	metaAllocator    = 56 // 4
+	metaKeyFlags     = 60 // 4
+	metaKeyID        = 64 // 8，0表示没有加密
+	metaEpoch        = 72 // 4，FlushAll时加1，doc中记录的epoch和这里不一样就是无效的
+	metaBloomGen     = 80 // 8，重建bloom filter的开始和结束各加1，奇数表示正在重建，见bloom.go
+)
+
+// metaFlags
+const (
+	flagDeduped = 1 << iota // 已经清理过重复的key
+	flagBloom               // bloom filter是完整的
+	flagUsage               // bucket表中的用量是准确的
+)
+
+const metaSize = 4096
+const journalOffset = metaSize
+const journalSize = 131072
+
+func blockOffset(j int) int {
+	return headerSize + j*bufSize
+}
+
+func (r *CacheImpl) blocks() int {
+	return (int(r.fileStat.Size()) - headerSize) / bufSize
+}
+
+func (r *CacheImpl) headerUint32(offset int) uint32 {
+	return binary.LittleEndian.Uint32(r.mmap[offset : offset+4])
+}
+
+func (r *CacheImpl) putHeaderUint32(offset int, v uint32) {
+	binary.LittleEndian.PutUint32(r.mmap[offset:offset+4], v)
+}
+
+func (r *CacheImpl) headerUint64(offset int) uint64 {
+	return binary.LittleEndian.Uint64(r.mmap[offset : offset+8])
+}
+
+func (r *CacheImpl) putHeaderUint64(offset int, v uint64) {
+	binary.LittleEndian.PutUint64(r.mmap[offset:offset+8], v)
+}
+
+func (r *CacheImpl) initHeader() {
+	copy(r.mmap[metaMagic:metaMagic+len(headerMagic)], headerMagic)
+	r.putHeaderUint32(metaVersion, headerVersion)
+	r.putHeaderUint32(metaFlags, flagDeduped|flagBloom|flagUsage)
+}
+
+func (r *CacheImpl) checkHeader() error {
+	if !bytes.Equal(r.mmap[metaMagic:metaMagic+len(headerMagic)], []byte(headerMagic)) {
+		return InvalidFileFormat
+	}
+	if r.headerUint32(metaVersion) != headerVersion {
+		return InvalidFileFormat
+	}
+	return nil
+}
+
+// 旧版本的文件没有header，大小是5M的整数倍
+// 升级的时候写到一个新文件，再rename回来，避免升级到一半的时候崩溃导致数据丢失
+func upgradeFile(filepath string, file *os.File) (*os.File, error) {
+	tmp := filepath + ".upgrade"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp)
+
+	header := make([]byte, headerSize)
+	copy(header[metaMagic:], headerMagic)
+	binary.LittleEndian.PutUint32(header[metaVersion:], headerVersion)
+	if _, err = out.Write(header); err != nil {
+		out.Close()
+		return nil, err
+	}
+	if _, err = io.Copy(out, io.NewSectionReader(file, 0, 1<<62)); err != nil {
+		out.Close()
+		return nil, err
+	}
+	if err = out.Sync(); err != nil {
+		out.Close()
+		return nil, err
+	}
+	if err = os.Rename(tmp, filepath); err != nil {
+		out.Close()
+		return nil, err
+	}
+	file.Close()
+
+	return out, nil
+}
@@ -0,0 +1,146 @@
+package filecache
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// 内存中的索引: bucket和key的hash -> doc的offset
+// 索引记录了它对应的header seq，seq和文件中的不一致说明文件被其他进程修改过，需要重建
+type index struct {
+	mu   sync.Mutex
+	seq  uint64
+	keys map[uint64]int // -1表示有多个key的hash相同，需要扫描
+}
+
+func keyHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+func (idx *index) put(key string, offset int) {
+	h := keyHash(key)
+	if old, ok := idx.keys[h]; ok && old != offset {
+		idx.keys[h] = -1
+		return
+	}
+	idx.keys[h] = offset
+}
+
+func (r *CacheImpl) buildIndex() error {
+	idx := r.index
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	return r.buildIndexLocked()
+}
+
+func (r *CacheImpl) buildIndexLocked() error {
+	idx := r.index
+	idx.keys = make(map[uint64]int)
+	idx.seq = r.headerUint64(metaSeq)
+	err := r.scan(func(kv *kv) error {
+		idx.put(nsKey(kv.ns, kv.rawKey), kv.offset)
+		return nil
+	})
+	if err != nil {
+		idx.keys = nil
+	}
+	return err
+}
+
+// 返回key所在的offset，-1表示不存在，ok为false时需要扫描
+func (r *CacheImpl) indexLookup(ns int, key string) (int, bool) {
+	idx := r.index
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if idx.keys == nil || idx.seq != r.headerUint64(metaSeq) {
+		if err := r.buildIndexLocked(); err != nil {
+			return 0, false
+		}
+	}
+
+	offset, ok := idx.keys[keyHash(nsKey(ns, key))]
+	if !ok {
+		return -1, true
+	} else if offset < 0 {
+		return 0, false
+	}
+	return offset, true
+}
+
+func (r *CacheImpl) indexPut(ns int, key string, offset int) {
+	if r.index == nil {
+		return
+	}
+	idx := r.index
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if idx.keys == nil {
+		return
+	}
+
+	h := keyHash(nsKey(ns, key))
+	if old, ok := idx.keys[h]; ok && old != offset {
+		// 旧的位置上还是另一个hash相同的key，只能标记为-1了
+		if old < 0 || (r.isUsed(old) && !r.docHasKey(old, ns, key)) {
+			idx.keys[h] = -1
+			return
+		}
+	}
+	idx.keys[h] = offset
+}
+
+func (r *CacheImpl) docHasKey(offset, ns int, key string) bool {
+	keyLen, err := binaryInt(r.mmap[offset+1 : offset+3])
+	if err != nil || keyLen != len(key) {
+		return false
+	}
+	if string(r.mmap[offset+docHeaderLength:offset+docHeaderLength+keyLen]) != key {
+		return false
+	}
+	ext, _, err := r.docExtHeader(offset)
+	return err == nil && ext.ns == ns
+}
+
+func (r *CacheImpl) indexDel(ns int, key string) {
+	if r.index == nil {
+		return
+	}
+	idx := r.index
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	h := keyHash(nsKey(ns, key))
+	if offset, ok := idx.keys[h]; ok && offset >= 0 {
+		delete(idx.keys, h)
+	}
+}
+
+// 自己修改了文件，如果修改之前索引是最新的，修改之后也是（调用方会更新索引）
+func (r *CacheImpl) indexFollow(seq uint64) {
+	if r.index == nil {
+		return
+	}
+	idx := r.index
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if idx.keys != nil && idx.seq == seq {
+		idx.seq = seq + 1
+	}
+}
+
+func (r *CacheImpl) indexReset() {
+	if r.index == nil {
+		return
+	}
+	idx := r.index
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.keys = nil
+}
@@ -0,0 +1,74 @@
+package filecache_test
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Chyroc/filecache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndex(t *testing.T) {
+	as := assert.New(t)
+	defer os.Remove("./test-index")
+
+	os.Remove("./test-index")
+	c := filecache.New("./test-index")
+	for i := 0; i < 5000; i++ {
+		j := strconv.Itoa(i)
+		as.Nil(c.Set(j, j, time.Minute))
+	}
+
+	idx, err := filecache.Open("./test-index", filecache.WithIndex())
+	as.Nil(err)
+
+	t.Run("built on open", func(t *testing.T) {
+		for i := 0; i < 5000; i++ {
+			j := strconv.Itoa(i)
+			v, err := idx.Get(j)
+			as.Nil(err)
+			as.Equal(j, v)
+		}
+		_, err := idx.Get("not-exist")
+		as.Equal(filecache.NotFound, err)
+	})
+
+	t.Run("set del expire", func(t *testing.T) {
+		as.Nil(idx.Set("k", "v", time.Minute))
+		v, err := idx.Get("k")
+		as.Nil(err)
+		as.Equal("v", v)
+
+		as.Nil(idx.Expire("k", time.Hour))
+		ttl, err := idx.TTL("k")
+		as.Nil(err)
+		as.True(ttl > time.Minute)
+
+		as.Nil(idx.Del("k"))
+		_, err = idx.Get("k")
+		as.Equal(filecache.NotFound, err)
+	})
+
+	t.Run("changed by other process", func(t *testing.T) {
+		as.Nil(c.Set("other", "1", time.Minute))
+		v, err := idx.Get("other")
+		as.Nil(err)
+		as.Equal("1", v)
+
+		as.Nil(c.Del("0"))
+		_, err = idx.Get("0")
+		as.Equal(filecache.NotFound, err)
+	})
+
+	t.Run("txn rollback", func(t *testing.T) {
+		txn := idx.Begin()
+		as.Nil(txn.Set("t", "1", time.Minute))
+		as.Nil(txn.Expire("not-exist", time.Minute))
+		as.Equal(filecache.NotFound, txn.Commit())
+
+		_, err := idx.Get("t")
+		as.Equal(filecache.NotFound, err)
+	})
+}
@@ -44,6 +44,21 @@ func (m *MMap) header() *reflect.SliceHeader {
 	return (*reflect.SliceHeader)(unsafe.Pointer(m))
 }
 
+// Flush synchronizes the mapping's contents to the file's contents on disk.
+func (m *MMap) Flush() error {
+	dh := m.header()
+	return flush(dh.Data, uintptr(dh.Len))
+}
+
+// FlushRange synchronizes length bytes starting at offset to the file on disk.
+// The start is rounded down to a page boundary.
+func (m *MMap) FlushRange(offset, length int) error {
+	page := os.Getpagesize()
+	start := offset / page * page
+	dh := m.header()
+	return flush(dh.Data+uintptr(start), uintptr(offset+length-start))
+}
+
 // Unmap deletes the memory mapped region, flushes any remaining changes, and sets
 // m to nil.
 // Trying to read or write any remaining references to m after Unmap is called will
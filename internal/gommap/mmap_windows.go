@@ -45,6 +45,11 @@ func mmap(length int, hfile uintptr) ([]byte, error) {
 	return m, nil
 }
 
+func flush(addr, len uintptr) error {
+	errno := syscall.FlushViewOfFile(addr, len)
+	return os.NewSyscallError("FlushViewOfFile", errno)
+}
+
 func unmap(addr, len uintptr) error {
 	if err := syscall.UnmapViewOfFile(addr); err != nil {
 		return err
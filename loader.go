@@ -0,0 +1,202 @@
+package filecache
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// LoaderPanicked 等待的loader panic了，panic只会在调用loader的goroutine中继续抛出
+// 后台重新加载的panic不会抛出，和返回的错误一样记在Stats.RefreshErrors中
+var LoaderPanicked = errors.New("loader panicked")
+
+type LoadOption func(*loadOptions)
+
+type loadOptions struct {
+	lockTimeout time.Duration
+	stale       time.Duration
+}
+
+// WithLoadLock 通过文件中的锁保证多个进程只有一个在加载，其他进程等它写入，最多等timeout
+// 加载的进程持有锁超过timeout之后，其他进程会自己加载
+func WithLoadLock(timeout time.Duration) LoadOption {
+	return func(o *loadOptions) {
+		o.lockTimeout = timeout
+	}
+}
+
+// WithStaleWhileRevalidate 过期不超过stale的数据直接返回旧的值，同时在后台重新加载
+func WithStaleWhileRevalidate(stale time.Duration) LoadOption {
+	return func(o *loadOptions) {
+		o.stale = stale
+	}
+}
+
+// 每个slot是一个uint64，记录锁的过期时间(ms)，过期了就认为没有被持有
+const loadLockOffset = slabOffset + slabEntrySize*entryCount*bufCount
+const loadLockSlots = 1024
+
+// GetOrLoad key不存在或者过期的时候调用loader加载，并以ttl写入
+// 同一个进程中同一个key同时只会有一个loader在执行，其他的等待它的结果
+func (r *CacheImpl) GetOrLoad(key string, ttl time.Duration, loader func() (string, error), opts ...LoadOption) (string, error) {
+	var o loadOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	r.mu.RLock()
+	kv, err := r.find(0, key)
+	r.mu.RUnlock()
+	if err == nil && kv.ttl >= 0 {
+		r.countGet(nil)
+		return kv.val, nil
+	} else if err != nil && err != NotFound {
+		return "", err
+	}
+	r.countGet(NotFound)
+
+	if kv != nil && time.Duration(-kv.ttl)*time.Millisecond <= o.stale {
+		go r.refresh(key, ttl, loader, &o)
+		return kv.val, nil
+	}
+	return r.load(key, ttl, loader, &o)
+}
+
+// 后台重新加载，没有调用方接收错误，只计数。panic的时候singleflight和加载锁在load的defer中释放
+func (r *CacheImpl) refresh(key string, ttl time.Duration, loader func() (string, error), o *loadOptions) {
+	defer func() {
+		if p := recover(); p != nil {
+			atomic.AddUint64(&r.stats.refreshErrors, 1)
+		}
+	}()
+	if _, err := r.load(key, ttl, loader, o); err != nil {
+		atomic.AddUint64(&r.stats.refreshErrors, 1)
+	}
+}
+
+func (r *CacheImpl) load(key string, ttl time.Duration, loader func() (string, error), o *loadOptions) (string, error) {
+	return r.loads.do(key, func() (string, error) {
+		if o.lockTimeout > 0 {
+			val, token, err := r.waitLoadLock(key, o.lockTimeout)
+			if err != nil || token == 0 {
+				return val, err
+			} else if token > 0 {
+				defer r.unlockLoad(key, token)
+			}
+		}
+
+		val, err := loader()
+		if err != nil {
+			return "", err
+		}
+		if err := r.Set(key, val, ttl); err != nil {
+			return "", err
+		}
+		return val, nil
+	})
+}
+
+// 拿到锁之后返回锁的token，等待的过程中其他进程已经写入了的话直接返回写入的值，token为0
+// 超时之后没有拿到锁也返回，token为-1
+func (r *CacheImpl) waitLoadLock(key string, timeout time.Duration) (string, int64, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		r.mu.RLock()
+		if r.err != nil {
+			r.mu.RUnlock()
+			return "", 0, r.err
+		}
+		token := r.tryLockLoad(key, timeout)
+		kv, err := r.get(0, key)
+		r.mu.RUnlock()
+
+		if err == nil {
+			if token > 0 {
+				r.unlockLoad(key, token)
+			}
+			return kv.val, 0, nil
+		} else if err != NotFound {
+			return "", 0, err
+		} else if token > 0 {
+			return "", token, nil
+		}
+
+		if time.Now().After(deadline) {
+			// 等不到就自己加载
+			return "", -1, nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// 需要持有r.mu，扩容的时候mmap会重新映射
+func (r *CacheImpl) loadLockSlot(key string) *uint64 {
+	offset := loadLockOffset + int(keyHash(key)%loadLockSlots)*8
+	return (*uint64)(unsafe.Pointer(&r.mmap[offset]))
+}
+
+// 拿到锁返回锁的过期时间作为token，没有拿到返回0
+func (r *CacheImpl) tryLockLoad(key string, timeout time.Duration) int64 {
+	slot := r.loadLockSlot(key)
+	old := atomic.LoadUint64(slot)
+	if old >= uint64(unixMs(0)) {
+		return 0
+	}
+	token := unixMs(timeout)
+	if !atomic.CompareAndSwapUint64(slot, old, uint64(token)) {
+		return 0
+	}
+	return token
+}
+
+// 锁已经过期并且被其他进程拿走了的话不会释放
+func (r *CacheImpl) unlockLoad(key string, token int64) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.err == Closed {
+		return
+	}
+	atomic.CompareAndSwapUint64(r.loadLockSlot(key), uint64(token), 0)
+}
+
+// 进程内的singleflight
+type loadGroup struct {
+	mu    sync.Mutex
+	calls map[string]*loadCall
+}
+
+type loadCall struct {
+	wg  sync.WaitGroup
+	val string
+	err error
+}
+
+func (g *loadGroup) do(key string, fn func() (string, error)) (string, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*loadCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.val, c.err
+	}
+	// fn panic的话等待的goroutine拿到的是LoaderPanicked
+	c := &loadCall{err: LoaderPanicked}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		c.wg.Done()
+	}()
+
+	c.val, c.err = fn()
+	return c.val, c.err
+}
@@ -0,0 +1,171 @@
+package filecache_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Chyroc/filecache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetOrLoad(t *testing.T) {
+	as := assert.New(t)
+	defer os.Remove("./test-load")
+	os.Remove("./test-load")
+
+	c, err := filecache.Open("./test-load")
+	as.Nil(err)
+	defer c.Close()
+
+	t.Run("singleflight", func(t *testing.T) {
+		var loads int32
+		loader := func() (string, error) {
+			atomic.AddInt32(&loads, 1)
+			time.Sleep(50 * time.Millisecond)
+			return "v", nil
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				v, err := c.GetOrLoad("k", time.Minute, loader)
+				as.Nil(err)
+				as.Equal("v", v)
+			}()
+		}
+		wg.Wait()
+		as.Equal(int32(1), loads)
+
+		v, err := c.GetOrLoad("k", time.Minute, loader)
+		as.Nil(err)
+		as.Equal("v", v)
+		as.Equal(int32(1), loads)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		failed := errors.New("failed")
+		_, err := c.GetOrLoad("err", time.Minute, func() (string, error) {
+			return "", failed
+		})
+		as.Equal(failed, err)
+		_, err = c.Get("err")
+		as.Equal(filecache.NotFound, err)
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		started := make(chan struct{})
+		release := make(chan struct{})
+		errs := make(chan error, 10)
+		go func() {
+			defer func() {
+				errs <- fmt.Errorf("%v", recover())
+			}()
+			_, _ = c.GetOrLoad("panic", time.Minute, func() (string, error) {
+				close(started)
+				<-release
+				panic("boom")
+			})
+		}()
+		<-started
+		for i := 0; i < 5; i++ {
+			go func() {
+				_, err := c.GetOrLoad("panic", time.Minute, func() (string, error) {
+					return "v", nil
+				})
+				errs <- err
+			}()
+		}
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+
+		// 只有调用loader的goroutine panic，等待的goroutine返回错误
+		panicked := 0
+		for i := 0; i < 6; i++ {
+			if err := <-errs; err != filecache.LoaderPanicked {
+				as.Equal("boom", err.Error())
+				panicked++
+			}
+		}
+		as.Equal(1, panicked)
+
+		// 之后可以重新加载
+		v, err := c.GetOrLoad("panic", time.Minute, func() (string, error) {
+			return "v", nil
+		})
+		as.Nil(err)
+		as.Equal("v", v)
+	})
+
+	t.Run("stale while revalidate", func(t *testing.T) {
+		as.Nil(c.Set("stale", "old", 50*time.Millisecond))
+		time.Sleep(100 * time.Millisecond)
+
+		v, err := c.GetOrLoad("stale", time.Minute, func() (string, error) {
+			return "new", nil
+		}, filecache.WithStaleWhileRevalidate(time.Minute))
+		as.Nil(err)
+		as.Equal("old", v)
+
+		time.Sleep(50 * time.Millisecond)
+		v, err = c.Get("stale")
+		as.Nil(err)
+		as.Equal("new", v)
+	})
+
+	t.Run("stale refresh panic", func(t *testing.T) {
+		as.Nil(c.Set("stale-panic", "old", 50*time.Millisecond))
+		time.Sleep(100 * time.Millisecond)
+
+		v, err := c.GetOrLoad("stale-panic", time.Minute, func() (string, error) {
+			panic("boom")
+		}, filecache.WithStaleWhileRevalidate(time.Minute), filecache.WithLoadLock(time.Second))
+		as.Nil(err)
+		as.Equal("old", v)
+		as.Eventually(func() bool { return c.Stats().RefreshErrors == 1 }, time.Second, 10*time.Millisecond)
+
+		// 加载锁已经释放，不用等到超时
+		start := time.Now()
+		v, err = c.GetOrLoad("stale-panic", time.Minute, func() (string, error) {
+			return "new", nil
+		}, filecache.WithLoadLock(time.Second))
+		as.Nil(err)
+		as.Equal("new", v)
+		as.True(time.Since(start) < 500*time.Millisecond)
+	})
+
+	t.Run("cross process lock", func(t *testing.T) {
+		// 另一个进程打开同一个文件
+		other, err := filecache.Open("./test-load")
+		as.Nil(err)
+		defer other.Close()
+
+		var loads int32
+		loader := func() (string, error) {
+			atomic.AddInt32(&loads, 1)
+			time.Sleep(200 * time.Millisecond)
+			return "locked", nil
+		}
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			v, err := c.GetOrLoad("lock", time.Minute, loader, filecache.WithLoadLock(time.Second))
+			as.Nil(err)
+			as.Equal("locked", v)
+		}()
+		time.Sleep(50 * time.Millisecond)
+
+		v, err := other.GetOrLoad("lock", time.Minute, loader, filecache.WithLoadLock(time.Second))
+		as.Nil(err)
+		as.Equal("locked", v)
+		<-done
+		as.Equal(int32(1), loads)
+	})
+}
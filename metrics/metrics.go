@@ -0,0 +1,345 @@
+// Package metrics 统计filecache.Cache的操作，按OpenMetrics的文本格式输出，Prometheus可以直接抓取
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Chyroc/filecache"
+)
+
+const ContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// 操作耗时的histogram的bucket，单位是秒
+var DefaultBuckets = []float64{.000001, .000005, .00001, .00005, .0001, .0005, .001, .005, .01, .05, .1}
+
+var ops = []string{"get", "set", "ttl", "expire", "del", "range"}
+
+// 错误按照filecache中的错误变量统计，不在这里的算作other
+var errorNames = []struct {
+	err  error
+	name string
+}{
+	{filecache.NotFound, "not_found"},
+	{filecache.HashConflict, "hash_conflict"},
+	{filecache.KeyTooShort, "key_too_short"},
+	{filecache.KeyTooLong, "key_too_long"},
+	{filecache.ValueTooShort, "value_too_short"},
+	{filecache.ValueTooLong, "value_too_long"},
+	{filecache.InvalidFileSize, "invalid_file_size"},
+	{filecache.FileSizeTooLarge, "file_size_too_large"},
+	{filecache.InvalidFileFormat, "invalid_file_format"},
+	{filecache.Closed, "closed"},
+	{filecache.QuotaExceeded, "quota_exceeded"},
+	{filecache.EncryptionKeyRequired, "encryption_key_required"},
+	{filecache.WrongEncryptionKey, "wrong_encryption_key"},
+	{filecache.DecryptFailed, "decrypt_failed"},
+	{filecache.InvalidCompressedValue, "invalid_compressed_value"},
+}
+
+func errorName(err error) string {
+	for _, e := range errorNames {
+		if err == e.err {
+			return e.name
+		}
+	}
+	return "other"
+}
+
+// 遍历文件得到的用量默认缓存多久
+const DefaultStatsInterval = time.Minute
+
+// Cache 记录每个操作的次数、耗时和错误，本身也是一个filecache.Cache
+// 被包装的cache有Stats() *filecache.Stats方法时（比如*filecache.CacheImpl），输出时还会带上文件的用量
+// Stats()要遍历整个文件，结果会缓存一段时间，有HeaderStats()的话header中记录了的计数每次都是最新的
+type Cache struct {
+	cache         filecache.Cache
+	buckets       []float64
+	ops           map[string]*opStats
+	statsInterval time.Duration
+
+	statsMu sync.Mutex
+	stats   *filecache.Stats
+	statsAt time.Time
+}
+
+type opStats struct {
+	mu     sync.Mutex
+	count  uint64
+	sum    float64  // 秒
+	counts []uint64 // 每个bucket的数量，不是累计的，最后一个是+Inf
+	errors map[string]uint64
+}
+
+type Option func(*Cache)
+
+// WithStatsInterval 遍历文件得到的用量最多缓存interval，为0时每次输出都遍历
+func WithStatsInterval(interval time.Duration) Option {
+	return func(c *Cache) {
+		c.statsInterval = interval
+	}
+}
+
+// WithBuckets 操作耗时的histogram的bucket，单位是秒，需要从小到大排列
+func WithBuckets(buckets []float64) Option {
+	return func(c *Cache) {
+		c.buckets = buckets
+	}
+}
+
+func Wrap(cache filecache.Cache, opts ...Option) *Cache {
+	c := &Cache{
+		cache:         cache,
+		buckets:       DefaultBuckets,
+		ops:           make(map[string]*opStats),
+		statsInterval: DefaultStatsInterval,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	for _, op := range ops {
+		c.ops[op] = &opStats{
+			counts: make([]uint64, len(c.buckets)+1),
+			errors: make(map[string]uint64),
+		}
+	}
+	return c
+}
+
+func (c *Cache) observe(op string, start time.Time, err error) {
+	d := time.Since(start).Seconds()
+	s := c.ops[op]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.count++
+	s.sum += d
+	i := 0
+	for i < len(c.buckets) && d > c.buckets[i] {
+		i++
+	}
+	s.counts[i]++
+	if err != nil {
+		s.errors[errorName(err)]++
+	}
+}
+
+func (c *Cache) Get(key string) (string, error) {
+	start := time.Now()
+	val, err := c.cache.Get(key)
+	c.observe("get", start, err)
+	return val, err
+}
+
+func (c *Cache) Set(key, val string, ttl time.Duration) error {
+	start := time.Now()
+	err := c.cache.Set(key, val, ttl)
+	c.observe("set", start, err)
+	return err
+}
+
+func (c *Cache) TTL(key string) (time.Duration, error) {
+	start := time.Now()
+	ttl, err := c.cache.TTL(key)
+	c.observe("ttl", start, err)
+	return ttl, err
+}
+
+func (c *Cache) Expire(key string, ttl time.Duration) error {
+	start := time.Now()
+	err := c.cache.Expire(key, ttl)
+	c.observe("expire", start, err)
+	return err
+}
+
+func (c *Cache) Del(key string) error {
+	start := time.Now()
+	err := c.cache.Del(key)
+	c.observe("del", start, err)
+	return err
+}
+
+func (c *Cache) Range() ([]*filecache.KV, error) {
+	start := time.Now()
+	kvs, err := c.cache.Range()
+	c.observe("range", start, err)
+	return kvs, err
+}
+
+// ServeHTTP 输出OpenMetrics格式的指标，可以直接注册为/metrics
+func (c *Cache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	c.WriteTo(w)
+}
+
+// WriteTo 按OpenMetrics的文本格式写出所有的指标，以# EOF结束
+func (c *Cache) WriteTo(w io.Writer) (int64, error) {
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	c.writeOps(bw)
+	if full := c.fullStats(); full != nil {
+		s := full
+		if h, ok := c.cache.(interface{ HeaderStats() *filecache.Stats }); ok {
+			s = h.HeaderStats()
+		}
+		writeStats(bw, s, full)
+	}
+	bw.WriteString("# EOF\n")
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// 缓存的Stats()，被包装的cache没有Stats()时返回nil
+func (c *Cache) fullStats() *filecache.Stats {
+	s, ok := c.cache.(interface{ Stats() *filecache.Stats })
+	if !ok {
+		return nil
+	}
+
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	if c.stats == nil || time.Since(c.statsAt) >= c.statsInterval {
+		c.stats, c.statsAt = s.Stats(), time.Now()
+	}
+	return c.stats
+}
+
+func (c *Cache) writeOps(w *bufio.Writer) {
+	type snapshot struct {
+		count  uint64
+		sum    float64
+		counts []uint64
+		errors map[string]uint64
+	}
+	snapshots := make([]snapshot, len(ops))
+	var hits, misses uint64
+	for i, op := range ops {
+		s := c.ops[op]
+		s.mu.Lock()
+		snapshots[i] = snapshot{count: s.count, sum: s.sum, counts: append([]uint64(nil), s.counts...), errors: make(map[string]uint64)}
+		for k, v := range s.errors {
+			snapshots[i].errors[k] = v
+		}
+		s.mu.Unlock()
+	}
+	get := snapshots[0]
+	misses = get.errors["not_found"]
+	hits = get.count
+	for _, n := range get.errors {
+		hits -= n
+	}
+
+	header(w, "filecache_operations", "counter", "Number of cache operations.")
+	for i, op := range ops {
+		fmt.Fprintf(w, "filecache_operations_total{op=%q} %d\n", op, snapshots[i].count)
+	}
+
+	header(w, "filecache_operation_duration_seconds", "histogram", "Latency of cache operations.")
+	for i, op := range ops {
+		var cumulative uint64
+		for j, le := range c.buckets {
+			cumulative += snapshots[i].counts[j]
+			fmt.Fprintf(w, "filecache_operation_duration_seconds_bucket{op=%q,le=%q} %d\n", op, formatFloat(le), cumulative)
+		}
+		fmt.Fprintf(w, "filecache_operation_duration_seconds_bucket{op=%q,le=\"+Inf\"} %d\n", op, snapshots[i].count)
+		fmt.Fprintf(w, "filecache_operation_duration_seconds_count{op=%q} %d\n", op, snapshots[i].count)
+		fmt.Fprintf(w, "filecache_operation_duration_seconds_sum{op=%q} %s\n", op, formatFloat(snapshots[i].sum))
+	}
+
+	header(w, "filecache_errors", "counter", "Number of failed cache operations by error.")
+	for i, op := range ops {
+		for _, e := range errorNames {
+			if n := snapshots[i].errors[e.name]; n > 0 {
+				fmt.Fprintf(w, "filecache_errors_total{op=%q,error=%q} %d\n", op, e.name, n)
+			}
+		}
+		if n := snapshots[i].errors["other"]; n > 0 {
+			fmt.Fprintf(w, "filecache_errors_total{op=%q,error=\"other\"} %d\n", op, n)
+		}
+	}
+
+	header(w, "filecache_get_hit_ratio", "gauge", "Ratio of Get calls that found a value.")
+	ratio := 0.0
+	if hits+misses > 0 {
+		ratio = float64(hits) / float64(hits+misses)
+	}
+	fmt.Fprintf(w, "filecache_get_hit_ratio %s\n", formatFloat(ratio))
+}
+
+// 计数和header中有的用量来自s，需要遍历文件的来自full
+func writeStats(w *bufio.Writer, s, full *filecache.Stats) {
+	counters := []struct {
+		name, help string
+		value      uint64
+	}{
+		{"filecache_hits", "Reads that found a value, from all callers in this process.", s.Hits},
+		{"filecache_misses", "Reads that found nothing, from all callers in this process.", s.Misses},
+		{"filecache_expirations", "Expired entries reclaimed by this process.", s.Expirations},
+		{"filecache_evictions", "Live entries removed by FlushAll or Bucket.Flush in this process.", s.Evictions},
+		{"filecache_hash_conflicts", "Sets that found every region for the key full.", s.HashConflicts},
+		{"filecache_bloom_checks", "Bloom filter lookups.", s.BloomChecks},
+		{"filecache_bloom_false_positives", "Bloom filter lookups that said maybe for a missing key.", s.BloomFalsePositives},
+	}
+	for _, c := range counters {
+		header(w, c.name, "counter", c.help)
+		fmt.Fprintf(w, "%s_total %d\n", c.name, c.value)
+	}
+
+	gauges := []struct {
+		name, help string
+		value      float64
+	}{
+		{"filecache_len", "Entries in the file, including expired ones not yet reclaimed.", float64(s.Len)},
+		{"filecache_entries", "Live entries in the file.", float64(full.Entries)},
+		{"filecache_stale_entries", "Entries past their ttl but within the grace period.", float64(full.Stale)},
+		{"filecache_expired_entries", "Expired entries not yet reclaimed.", float64(full.Expired)},
+		{"filecache_used_bytes", "Total length of all docs.", float64(s.UsedBytes)},
+		{"filecache_allocated_bytes", "Space taken by all docs.", float64(full.AllocatedBytes)},
+		{"filecache_file_size_bytes", "Size of the cache file.", float64(s.FileSize)},
+		{"filecache_blocks", "Number of 5M blocks in the file.", float64(s.Blocks)},
+		{"filecache_hit_ratio", "Ratio of reads that found a value, from all callers in this process.", s.HitRatio()},
+	}
+	for _, g := range gauges {
+		header(w, g.name, "gauge", g.help)
+		fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.value))
+	}
+
+	header(w, "filecache_block_fill_ratio", "gauge", "Allocated part of each block.")
+	for j, fill := range full.BlockFill {
+		fmt.Fprintf(w, "filecache_block_fill_ratio{block=\"%d\"} %s\n", j, formatFloat(fill))
+	}
+
+	// 和Stats.RegionFill一样不是累计的，fill是区间的下限
+	header(w, "filecache_regions", "gauge", "Number of regions by allocated part, fill is the lower bound of each 10% range.")
+	for i, n := range full.RegionFill {
+		fmt.Fprintf(w, "filecache_regions{fill=\"%s\"} %d\n", formatFloat(float64(i)/10), n)
+	}
+}
+
+func header(w *bufio.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# TYPE %s %s\n# HELP %s %s\n", name, typ, name, help)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,103 @@
+package metrics_test
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Chyroc/filecache"
+	"github.com/Chyroc/filecache/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	as := assert.New(t)
+	defer os.Remove("./test-metrics")
+	os.Remove("./test-metrics")
+
+	c, err := filecache.Open("./test-metrics")
+	as.Nil(err)
+	defer c.Close()
+
+	m := metrics.Wrap(c)
+	as.Nil(m.Set("k", "v", time.Minute))
+	_, err = m.Get("k")
+	as.Nil(err)
+	_, err = m.Get("not-exist")
+	as.Equal(filecache.NotFound, err)
+	as.Equal(filecache.KeyTooShort, m.Set("", "v", time.Minute))
+	as.Nil(m.Del("k"))
+
+	t.Run("write", func(t *testing.T) {
+		var buf bytes.Buffer
+		n, err := m.WriteTo(&buf)
+		as.Nil(err)
+		as.Equal(int64(buf.Len()), n)
+
+		out := buf.String()
+		as.True(strings.HasSuffix(out, "# EOF\n"))
+		as.Contains(out, "# TYPE filecache_operations counter\n")
+		as.Contains(out, `filecache_operations_total{op="get"} 2`+"\n")
+		as.Contains(out, `filecache_operations_total{op="set"} 2`+"\n")
+		as.Contains(out, `filecache_operations_total{op="expire"} 0`+"\n")
+		as.Contains(out, `filecache_operation_duration_seconds_bucket{op="get",le="+Inf"} 2`+"\n")
+		as.Contains(out, `filecache_operation_duration_seconds_count{op="del"} 1`+"\n")
+		as.Contains(out, `filecache_errors_total{op="get",error="not_found"} 1`+"\n")
+		as.Contains(out, `filecache_errors_total{op="set",error="key_too_short"} 1`+"\n")
+		as.Contains(out, "filecache_get_hit_ratio 0.5\n")
+
+		// 来自Stats
+		as.Contains(out, "filecache_file_size_bytes 6.291456e+06\n")
+		as.Contains(out, "filecache_blocks 1\n")
+		as.Contains(out, "filecache_len 0\n")
+		as.Contains(out, `filecache_regions{fill="0"} 512`+"\n")
+		as.Contains(out, `filecache_block_fill_ratio{block="0"} 0`+"\n")
+	})
+
+	t.Run("buckets", func(t *testing.T) {
+		m := metrics.Wrap(c, metrics.WithBuckets([]float64{0, 10}))
+		_, err := m.Get("k")
+		as.Equal(filecache.NotFound, err)
+
+		var buf bytes.Buffer
+		_, err = m.WriteTo(&buf)
+		as.Nil(err)
+		out := buf.String()
+		as.Contains(out, `filecache_operation_duration_seconds_bucket{op="get",le="0"} 0`+"\n")
+		as.Contains(out, `filecache_operation_duration_seconds_bucket{op="get",le="10"} 1`+"\n")
+		as.Contains(out, "filecache_get_hit_ratio 0\n")
+	})
+
+	t.Run("stats interval", func(t *testing.T) {
+		scrape := func(m *metrics.Cache) string {
+			var buf bytes.Buffer
+			_, err := m.WriteTo(&buf)
+			as.Nil(err)
+			return buf.String()
+		}
+
+		m := metrics.Wrap(c)
+		as.Contains(scrape(m), "filecache_entries 0\n")
+
+		// header中的计数每次都是最新的，遍历文件得到的在interval内用缓存的
+		as.Nil(c.Set("k", "v", time.Minute))
+		out := scrape(m)
+		as.Contains(out, "filecache_len 1\n")
+		as.Contains(out, "filecache_entries 0\n")
+
+		m = metrics.Wrap(c, metrics.WithStatsInterval(0))
+		as.Contains(scrape(m), "filecache_entries 1\n")
+		as.Nil(c.Del("k"))
+		as.Contains(scrape(m), "filecache_entries 0\n")
+	})
+
+	t.Run("http", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		as.Equal(metrics.ContentType, w.Header().Get("Content-Type"))
+		as.Contains(w.Body.String(), "filecache_operations_total")
+	})
+}
@@ -0,0 +1,163 @@
+package filecache
+
+import (
+	"time"
+)
+
+// Middleware 包装一个Cache，可以在每个方法前后加上日志、统计、trace等，不需要改CacheImpl
+type Middleware func(next Cache) Cache
+
+// Chain 用middlewares依次包装cache，第一个在最外层，最先被调用
+func Chain(cache Cache, middlewares ...Middleware) Cache {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		cache = middlewares[i](cache)
+	}
+	return cache
+}
+
+// Interceptor 在每个Cache方法外面调用，op是方法名（Get、Set、TTL、Expire、Del、Range），Range的key为空
+// call执行实际的操作并返回它的错误，Interceptor需要调用call并返回它的错误（或者替换成别的错误）
+// 不调用call的话方法返回零值
+type Interceptor func(op, key string, call func() error) error
+
+// Intercept 用fn包装每个方法，只关心方法名、key和错误的时候比实现整个Cache简单
+func Intercept(fn Interceptor) Middleware {
+	return func(next Cache) Cache {
+		return &interceptCache{next: next, fn: fn}
+	}
+}
+
+type interceptCache struct {
+	next Cache
+	fn   Interceptor
+}
+
+func (c *interceptCache) Get(key string) (val string, err error) {
+	err = c.fn("Get", key, func() error {
+		val, err = c.next.Get(key)
+		return err
+	})
+	return val, err
+}
+
+func (c *interceptCache) Set(key, val string, ttl time.Duration) error {
+	return c.fn("Set", key, func() error {
+		return c.next.Set(key, val, ttl)
+	})
+}
+
+func (c *interceptCache) TTL(key string) (ttl time.Duration, err error) {
+	err = c.fn("TTL", key, func() error {
+		ttl, err = c.next.TTL(key)
+		return err
+	})
+	return ttl, err
+}
+
+func (c *interceptCache) Expire(key string, ttl time.Duration) error {
+	return c.fn("Expire", key, func() error {
+		return c.next.Expire(key, ttl)
+	})
+}
+
+func (c *interceptCache) Del(key string) error {
+	return c.fn("Del", key, func() error {
+		return c.next.Del(key)
+	})
+}
+
+func (c *interceptCache) Range() (kvs []*KV, err error) {
+	err = c.fn("Range", "", func() error {
+		kvs, err = c.next.Range()
+		return err
+	})
+	return kvs, err
+}
+
+// Hooks 在操作成功之后调用，为nil的不调用。hook在调用方的goroutine中同步执行，不要在里面做耗时的操作
+// OnHit、OnMiss、OnSet、OnDel、OnSetTTL只能看到经过这个Cache的操作，其他进程的写入、直接对CacheImpl的调用都看不到
+// OnEvict、OnExpire注册到最里面的CacheImpl或者TieredCache上，和WithOnEvict、WithOnExpire一样，所有bucket的数据都会通知
+// 中间隔着本包以外的middleware时注册不到，不会调用
+type Hooks struct {
+	OnHit    func(key, val string)                    // Get读到了数据
+	OnMiss   func(key string)                         // Get返回NotFound
+	OnSet    func(key, val string, ttl time.Duration) // Set成功
+	OnDel    func(key string)                         // Del成功，key不存在时Del也会成功
+	OnSetTTL func(key string, ttl time.Duration)      // Expire成功，ttl是新的过期时间
+	OnEvict  func(e EvictedEvent)                     // FlushAll、Bucket.Flush删除了数据，TieredCache从L1中淘汰了数据，见WithOnEvict
+	OnExpire func(e ExpiredEvent)                     // 数据过期被清理，在后台的goroutine中调用，见WithOnExpire
+}
+
+// WithHooks 在操作之后调用hooks，OnEvict和OnExpire在包装的时候注册，之后一直有效
+func WithHooks(hooks Hooks) Middleware {
+	return func(next Cache) Cache {
+		if r, ok := next.(hookRegistry); ok && (hooks.OnEvict != nil || hooks.OnExpire != nil) {
+			r.addHooks(hooks.OnEvict, hooks.OnExpire)
+		}
+		return &hookCache{next: next, hooks: hooks}
+	}
+}
+
+// 能通知淘汰和过期的Cache，middleware转发给里面的Cache。fn为nil的不注册
+type hookRegistry interface {
+	addHooks(onEvict func(EvictedEvent), onExpire func(ExpiredEvent))
+}
+
+func (c *interceptCache) addHooks(onEvict func(EvictedEvent), onExpire func(ExpiredEvent)) {
+	if r, ok := c.next.(hookRegistry); ok {
+		r.addHooks(onEvict, onExpire)
+	}
+}
+
+func (c *hookCache) addHooks(onEvict func(EvictedEvent), onExpire func(ExpiredEvent)) {
+	if r, ok := c.next.(hookRegistry); ok {
+		r.addHooks(onEvict, onExpire)
+	}
+}
+
+type hookCache struct {
+	next  Cache
+	hooks Hooks
+}
+
+func (c *hookCache) Get(key string) (string, error) {
+	val, err := c.next.Get(key)
+	if err == nil && c.hooks.OnHit != nil {
+		c.hooks.OnHit(key, val)
+	} else if err == NotFound && c.hooks.OnMiss != nil {
+		c.hooks.OnMiss(key)
+	}
+	return val, err
+}
+
+func (c *hookCache) Set(key, val string, ttl time.Duration) error {
+	err := c.next.Set(key, val, ttl)
+	if err == nil && c.hooks.OnSet != nil {
+		c.hooks.OnSet(key, val, ttl)
+	}
+	return err
+}
+
+func (c *hookCache) TTL(key string) (time.Duration, error) {
+	return c.next.TTL(key)
+}
+
+func (c *hookCache) Expire(key string, ttl time.Duration) error {
+	err := c.next.Expire(key, ttl)
+	if err == nil && c.hooks.OnSetTTL != nil {
+		c.hooks.OnSetTTL(key, ttl)
+	}
+	return err
+}
+
+func (c *hookCache) Del(key string) error {
+	err := c.next.Del(key)
+	if err == nil && c.hooks.OnDel != nil {
+		c.hooks.OnDel(key)
+	}
+	return err
+}
+
+func (c *hookCache) Range() ([]*KV, error) {
+	return c.next.Range()
+}
@@ -0,0 +1,39 @@
+//go:build go1.21
+// +build go1.21
+
+package filecache
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// WithLogger 每个操作用logger记录一条日志，包括方法名、key、耗时和错误
+// 成功和NotFound用level，其他错误用slog.LevelError
+func WithLogger(logger *slog.Logger, level slog.Level) Middleware {
+	return Intercept(func(op, key string, call func() error) error {
+		start := time.Now()
+		err := call()
+
+		lv := level
+		if err != nil && err != NotFound {
+			lv = slog.LevelError
+		}
+		if !logger.Enabled(context.Background(), lv) {
+			return err
+		}
+		attrs := []slog.Attr{
+			slog.String("op", op),
+			slog.Duration("elapsed", time.Since(start)),
+		}
+		if op != "Range" {
+			attrs = append(attrs, slog.String("key", key))
+		}
+		if err != nil {
+			attrs = append(attrs, slog.String("error", err.Error()))
+		}
+		logger.LogAttrs(context.Background(), lv, "filecache "+op, attrs...)
+		return err
+	})
+}
@@ -0,0 +1,40 @@
+//go:build go1.21
+// +build go1.21
+
+package filecache_test
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Chyroc/filecache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithLogger(t *testing.T) {
+	as := assert.New(t)
+	defer os.Remove("./test-middleware-slog")
+	os.Remove("./test-middleware-slog")
+
+	c, err := filecache.Open("./test-middleware-slog")
+	as.Nil(err)
+	defer c.Close()
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	cache := filecache.Chain(c, filecache.WithLogger(logger, slog.LevelDebug))
+
+	// LevelDebug的不输出
+	as.Nil(cache.Set("k", "v", time.Minute))
+	_, err = cache.Get("not-exist")
+	as.Equal(filecache.NotFound, err)
+	as.Equal("", buf.String())
+
+	as.Equal(filecache.KeyTooLong, cache.Set(string(make([]byte, 300)), "v", time.Minute))
+	as.Contains(buf.String(), "level=ERROR")
+	as.Contains(buf.String(), "op=Set")
+	as.Contains(buf.String(), `error="key too long"`)
+}
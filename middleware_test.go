@@ -0,0 +1,113 @@
+package filecache_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Chyroc/filecache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddleware(t *testing.T) {
+	as := assert.New(t)
+	defer os.Remove("./test-middleware")
+	os.Remove("./test-middleware")
+
+	c, err := filecache.Open("./test-middleware")
+	as.Nil(err)
+	defer c.Close()
+
+	t.Run("chain", func(t *testing.T) {
+		var calls []string
+		trace := func(name string) filecache.Middleware {
+			return filecache.Intercept(func(op, key string, call func() error) error {
+				calls = append(calls, name+" "+op+" "+key)
+				return call()
+			})
+		}
+		cache := filecache.Chain(c, trace("a"), trace("b"))
+
+		as.Nil(cache.Set("k", "v", time.Minute))
+		val, err := cache.Get("k")
+		as.Nil(err)
+		as.Equal("v", val)
+		ttl, err := cache.TTL("k")
+		as.Nil(err)
+		as.True(ttl > 0)
+		kvs, err := cache.Range()
+		as.Nil(err)
+		as.Len(kvs, 1)
+		as.Equal([]string{"a Set k", "b Set k", "a Get k", "b Get k", "a TTL k", "b TTL k", "a Range ", "b Range "}, calls)
+	})
+
+	t.Run("intercept", func(t *testing.T) {
+		cache := filecache.Chain(c, filecache.Intercept(func(op, key string, call func() error) error {
+			if key == "readonly" && op != "Get" {
+				return filecache.Closed
+			}
+			return call()
+		}))
+		as.Equal(filecache.Closed, cache.Set("readonly", "v", time.Minute))
+		_, err := cache.Get("readonly")
+		as.Equal(filecache.NotFound, err)
+	})
+
+	t.Run("hooks", func(t *testing.T) {
+		var events []string
+		cache := filecache.Chain(c, filecache.WithHooks(filecache.Hooks{
+			OnHit:    func(key, val string) { events = append(events, "hit "+key+" "+val) },
+			OnMiss:   func(key string) { events = append(events, "miss "+key) },
+			OnSet:    func(key, val string, ttl time.Duration) { events = append(events, "set "+key+" "+val) },
+			OnDel:    func(key string) { events = append(events, "del "+key) },
+			OnSetTTL: func(key string, ttl time.Duration) { events = append(events, "set ttl "+key) },
+		}))
+
+		as.Nil(cache.Set("h", "v", time.Minute))
+		_, err := cache.Get("h")
+		as.Nil(err)
+		as.Nil(cache.Expire("h", time.Hour))
+		as.Nil(cache.Del("h"))
+		_, err = cache.Get("h")
+		as.Equal(filecache.NotFound, err)
+		as.Equal(filecache.KeyTooShort, cache.Set("", "v", time.Minute))
+		as.Equal([]string{"set h v", "hit h v", "set ttl h", "del h", "miss h"}, events)
+	})
+	t.Run("evict and expire hooks", func(t *testing.T) {
+		defer os.Remove("./test-middleware-hooks")
+		os.Remove("./test-middleware-hooks")
+		c, err := filecache.Open("./test-middleware-hooks", filecache.WithJanitor(20*time.Millisecond))
+		as.Nil(err)
+		defer c.Close()
+
+		var evicted []filecache.EvictedEvent
+		expired := make(chan filecache.ExpiredEvent, 10)
+		// 隔着一层middleware也能注册到CacheImpl上
+		cache := filecache.Chain(c, filecache.WithHooks(filecache.Hooks{
+			OnEvict:  func(e filecache.EvictedEvent) { evicted = append(evicted, e) },
+			OnExpire: func(e filecache.ExpiredEvent) { expired <- e },
+		}), filecache.Intercept(func(op, key string, call func() error) error {
+			return call()
+		}))
+
+		b, err := c.Bucket("b")
+		as.Nil(err)
+		as.Nil(cache.Set("k1", "v1", time.Minute))
+		as.Nil(b.Set("k2", "v2", time.Minute))
+		as.Nil(b.Flush())
+		as.Equal([]filecache.EvictedEvent{{Key: "k2", Val: "v2", Bucket: "b"}}, evicted)
+
+		// 已经过期的不算淘汰
+		evicted = nil
+		as.Nil(c.SetWithGrace("stale", "v", time.Millisecond, time.Millisecond))
+		time.Sleep(5 * time.Millisecond)
+		as.Nil(c.FlushAll(false))
+		as.Equal([]filecache.EvictedEvent{{Key: "k1", Val: "v1"}}, evicted)
+
+		as.Nil(cache.Set("k3", "v3", 30*time.Millisecond))
+		e, ok := readExpired(expired)
+		as.True(ok)
+		as.Equal("k3", e.Key)
+		as.Equal("v3", e.Val)
+	})
+}
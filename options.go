@@ -0,0 +1,54 @@
+package filecache
+
+import (
+	"time"
+)
+
+type Option func(*options)
+
+type options struct {
+	wal                  bool
+	walSync              SyncPolicy
+	walCheckpointSize    int64
+	index                bool
+	placement            Placement
+	hasher               Hasher
+	allocator            Allocator
+	compression          Compression
+	compressionThreshold int
+	encryptionKey        []byte
+	hashKeys             bool
+	janitorInterval      time.Duration
+	onExpire             []func(ExpiredEvent)
+	onEvict              []func(EvictedEvent)
+}
+
+func defaultOptions() options {
+	return options{
+		walSync:           SyncAlways,
+		walCheckpointSize: 64 << 20,
+	}
+}
+
+// WithWAL 开启wal，修改操作会先按照policy写到 filepath.wal 中，再修改mmap
+// 多个进程可以同时开启，写wal和修改mmap时会锁住wal文件，修改操作在进程之间是串行的
+func WithWAL(policy SyncPolicy) Option {
+	return func(o *options) {
+		o.wal = true
+		o.walSync = policy
+	}
+}
+
+// WithWALCheckpointSize wal文件超过size之后自动checkpoint
+func WithWALCheckpointSize(size int64) Option {
+	return func(o *options) {
+		o.walCheckpointSize = size
+	}
+}
+
+// WithIndex 在内存中维护key到doc的索引，get不需要再扫描每个block
+func WithIndex() Option {
+	return func(o *options) {
+		o.index = true
+	}
+}
@@ -0,0 +1,128 @@
+// Package otelcache 为filecache.Cache的每个操作创建OpenTelemetry的span
+package otelcache
+
+import (
+	"context"
+	"time"
+
+	"github.com/Chyroc/filecache"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/Chyroc/filecache/otelcache"
+
+type options struct {
+	tracer   trace.Tracer
+	withKeys bool
+}
+
+type Option func(*options)
+
+// WithTracerProvider 默认用otel.GetTracerProvider()
+func WithTracerProvider(provider trace.TracerProvider) Option {
+	return func(o *options) {
+		o.tracer = provider.Tracer(instrumentationName)
+	}
+}
+
+// WithKeys 在span上记录key，key中可能有用户的信息，默认不记录
+func WithKeys() Option {
+	return func(o *options) {
+		o.withKeys = true
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.tracer == nil {
+		o.tracer = otel.GetTracerProvider().Tracer(instrumentationName)
+	}
+	return o
+}
+
+// Middleware 每个操作一个名为filecache.<方法名>的span，NotFound不算错误，记录在filecache.hit上
+// Cache的方法没有context，span没有parent，需要挂在调用方的trace上时用WrapContext
+func Middleware(opts ...Option) filecache.Middleware {
+	o := newOptions(opts)
+	return filecache.Intercept(func(op, key string, call func() error) error {
+		return o.trace(context.Background(), op, key, call)
+	})
+}
+
+// WrapContext 和Middleware一样，span的parent是调用时传入的ctx中的span
+func WrapContext(next filecache.ContextCache, opts ...Option) filecache.ContextCache {
+	return &contextCache{next: next, o: newOptions(opts)}
+}
+
+func (o *options) trace(ctx context.Context, op, key string, call func() error) error {
+	attrs := []attribute.KeyValue{attribute.String("filecache.op", op)}
+	if o.withKeys && op != "Range" {
+		attrs = append(attrs, attribute.String("filecache.key", key))
+	}
+	_, span := o.tracer.Start(ctx, "filecache."+op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...))
+	defer span.End()
+
+	err := call()
+	if op == "Get" && (err == nil || err == filecache.NotFound) {
+		span.SetAttributes(attribute.Bool("filecache.hit", err == nil))
+	} else if err != nil && err != filecache.NotFound {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+type contextCache struct {
+	next filecache.ContextCache
+	o    *options
+}
+
+func (c *contextCache) GetCtx(ctx context.Context, key string) (val string, err error) {
+	err = c.o.trace(ctx, "Get", key, func() error {
+		val, err = c.next.GetCtx(ctx, key)
+		return err
+	})
+	return val, err
+}
+
+func (c *contextCache) SetCtx(ctx context.Context, key, val string, ttl time.Duration) error {
+	return c.o.trace(ctx, "Set", key, func() error {
+		return c.next.SetCtx(ctx, key, val, ttl)
+	})
+}
+
+func (c *contextCache) TTLCtx(ctx context.Context, key string) (ttl time.Duration, err error) {
+	err = c.o.trace(ctx, "TTL", key, func() error {
+		ttl, err = c.next.TTLCtx(ctx, key)
+		return err
+	})
+	return ttl, err
+}
+
+func (c *contextCache) ExpireCtx(ctx context.Context, key string, ttl time.Duration) error {
+	return c.o.trace(ctx, "Expire", key, func() error {
+		return c.next.ExpireCtx(ctx, key, ttl)
+	})
+}
+
+func (c *contextCache) DelCtx(ctx context.Context, key string) error {
+	return c.o.trace(ctx, "Del", key, func() error {
+		return c.next.DelCtx(ctx, key)
+	})
+}
+
+func (c *contextCache) RangeCtx(ctx context.Context) (kvs []*filecache.KV, err error) {
+	err = c.o.trace(ctx, "Range", "", func() error {
+		kvs, err = c.next.RangeCtx(ctx)
+		return err
+	})
+	return kvs, err
+}
@@ -0,0 +1,79 @@
+package otelcache_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Chyroc/filecache"
+	"github.com/Chyroc/filecache/otelcache"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestMiddleware(t *testing.T) {
+	as := assert.New(t)
+	defer os.Remove("./test-otel")
+	os.Remove("./test-otel")
+
+	c, err := filecache.Open("./test-otel")
+	as.Nil(err)
+	defer c.Close()
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	cache := filecache.Chain(c, otelcache.Middleware(otelcache.WithTracerProvider(provider), otelcache.WithKeys()))
+
+	as.Nil(cache.Set("k", "v", time.Minute))
+	_, err = cache.Get("k")
+	as.Nil(err)
+	_, err = cache.Get("not-exist")
+	as.Equal(filecache.NotFound, err)
+	as.Equal(filecache.KeyTooShort, cache.Del(""))
+
+	spans := recorder.Ended()
+	as.Len(spans, 4)
+	as.Equal("filecache.Set", spans[0].Name())
+	as.Contains(spans[0].Attributes(), attribute.String("filecache.key", "k"))
+	as.Contains(spans[1].Attributes(), attribute.Bool("filecache.hit", true))
+	as.Contains(spans[2].Attributes(), attribute.Bool("filecache.hit", false))
+	as.Equal(codes.Unset, spans[2].Status().Code)
+	as.Equal("filecache.Del", spans[3].Name())
+	as.Equal(codes.Error, spans[3].Status().Code)
+}
+
+func TestWrapContext(t *testing.T) {
+	as := assert.New(t)
+	defer os.Remove("./test-otel")
+	os.Remove("./test-otel")
+
+	c, err := filecache.Open("./test-otel")
+	as.Nil(err)
+	defer c.Close()
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	cache := otelcache.WrapContext(c, otelcache.WithTracerProvider(provider))
+
+	// span挂在调用方的span下面
+	ctx, parent := provider.Tracer("test").Start(context.Background(), "request")
+	as.Nil(cache.SetCtx(ctx, "k", "v", time.Minute))
+	v, err := cache.GetCtx(ctx, "k")
+	as.Nil(err)
+	as.Equal("v", v)
+	parent.End()
+
+	spans := recorder.Ended()
+	as.Len(spans, 3)
+	as.Equal("filecache.Set", spans[0].Name())
+	as.Equal("filecache.Get", spans[1].Name())
+	as.Contains(spans[1].Attributes(), attribute.Bool("filecache.hit", true))
+	for _, span := range spans[:2] {
+		as.Equal(parent.SpanContext().SpanID(), span.Parent().SpanID())
+		as.Equal(parent.SpanContext().TraceID(), span.SpanContext().TraceID())
+	}
+}
@@ -0,0 +1,16 @@
+package filecache
+
+// Placement 决定一个key可以放在哪些region中，新建文件时记录在header里，之后以文件中的为准
+type Placement uint32
+
+const (
+	PlacementRegion    Placement = iota // 只能放在hash对应的一个region中
+	PlacementTwoChoice                  // 两个hash对应两个region，放在空位更多的那个里
+)
+
+// WithPlacement 新建文件时使用的placement，打开已有的文件时使用文件中记录的
+func WithPlacement(placement Placement) Option {
+	return func(o *options) {
+		o.placement = placement
+	}
+}
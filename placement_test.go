@@ -0,0 +1,89 @@
+package filecache_test
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Chyroc/filecache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlacement(t *testing.T) {
+	as := assert.New(t)
+	defer os.Remove("./test-placement")
+
+	os.Remove("./test-placement")
+	c, err := filecache.Open("./test-placement", filecache.WithPlacement(filecache.PlacementTwoChoice))
+	as.Nil(err)
+
+	// 默认的方式下3000个key就会扩容
+	for i := 0; i < 3000; i++ {
+		j := strconv.Itoa(i)
+		as.Nil(c.Set(j, j, time.Minute))
+	}
+	fi, err := os.Stat("./test-placement")
+	as.Nil(err)
+	as.Equal(int64(1048576+5242880), fi.Size())
+
+	for i := 0; i < 3000; i++ {
+		j := strconv.Itoa(i)
+		v, err := c.Get(j)
+		as.Nil(err)
+		as.Equal(j, v)
+	}
+	as.Nil(c.Del("1"))
+	_, err = c.Get("1")
+	as.Equal(filecache.NotFound, err)
+	as.Nil(c.Close())
+
+	// 以文件中记录的为准
+	c, err = filecache.Open("./test-placement")
+	as.Nil(err)
+	v, err := c.Get("2999")
+	as.Nil(err)
+	as.Equal("2999", v)
+
+	report, err := filecache.Check("./test-placement")
+	as.Nil(err)
+	as.True(report.OK())
+}
+
+func BenchmarkPlacement(b *testing.B) {
+	for _, p := range []struct {
+		name      string
+		placement filecache.Placement
+	}{
+		{"region", filecache.PlacementRegion},
+		{"two-choice", filecache.PlacementTwoChoice},
+	} {
+		b.Run(p.name, func(b *testing.B) {
+			file := "./test-file-placement-" + p.name
+			defer os.Remove(file)
+
+			keys := 0
+			for i := 0; i < b.N; i++ {
+				os.Remove(file)
+				c, err := filecache.Open(file, filecache.WithPlacement(p.placement))
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				// 一直写到文件满了为止
+				for keys = 0; ; keys++ {
+					j := strconv.Itoa(keys)
+					if err := c.Set(j, j, time.Minute); err != nil {
+						break
+					}
+				}
+				if err := c.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ReportMetric(float64(keys), "keys")
+			b.ReportMetric(float64(keys)/float64(20*512*8)*100, "%used")
+		})
+	}
+}
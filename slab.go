@@ -0,0 +1,333 @@
+package filecache
+
+import (
+	"encoding/binary"
+)
+
+// Allocator 决定region中的空间怎么分配，新建文件时记录在header里，之后以文件中的为准
+type Allocator uint32
+
+const (
+	AllocFixed Allocator = iota // 每个region固定分成8个1280B的doc
+	AllocSlab                   // region按需分成64/128/256/512/1280B的slot，小的数据可以放得更密
+)
+
+// WithAllocator 新建文件时使用的allocator，打开已有的文件时使用文件中记录的
+func WithAllocator(allocator Allocator) Option {
+	return func(o *options) {
+		o.allocator = allocator
+	}
+}
+
+// doc的flag
+const (
+	docUsed      = 1 << 0
+	docCodecMask = 3 << 1 // value的压缩方式，见compression.go
+	docExt       = 1 << 3 // value前面有扩展头，见ext.go
+	docClassMask = 7 << 4 // slab模式下slot的class，slot的大小见slabClasses
+	docEncrypted = 1 << 7 // value是加密的，见encryption.go
+)
+
+// 下标是slot的class，class为0表示region中还没有分配出去的部分
+var slabClasses = [...]int{0, 64, 128, 256, 512, 1280}
+
+// slab模式下每个block的每个region在header中有一个分配表: tail(2) + 每个class的空闲链表头(2*5)
+// tail是region中还没有分配出去的部分的开始，链表头和空闲slot中的next都是region内的offset+1，0表示没有
+// 这样全0的分配表就是一个空的region。空闲slot的next记录在key_len的位置
+const slabOffset = bloomOffset + bloomSize*bufCount
+const slabEntrySize = 2 * len(slabClasses)
+
+func slotClass(flag byte) int {
+	return int(flag&docClassMask) >> 4
+}
+
+func slabClassOf(size int) int {
+	for c := 1; c < len(slabClasses); c++ {
+		if size <= slabClasses[c] {
+			return c
+		}
+	}
+	return 0
+}
+
+func slabEntry(j, region int) int {
+	return slabOffset + (j*entryCount+region)*slabEntrySize
+}
+
+func (r *CacheImpl) isUsed(offset int) bool {
+	return r.mmap[offset]&docUsed != 0
+}
+
+// doc所在slot的大小
+func (r *CacheImpl) slotSize(offset int) int {
+	return slotSize(r.mmap, r.layout.allocator, offset)
+}
+
+func slotSize(data []byte, allocator Allocator, offset int) int {
+	if allocator == AllocSlab {
+		return slabClasses[slotClass(data[offset])]
+	}
+	return docLength
+}
+
+// region中offset后面的一个doc（包括空的），offset为-1时返回第一个，没有了返回-1
+func (r *CacheImpl) nextDoc(regionOffset, offset int) int {
+	return nextDoc(r.mmap, r.layout.allocator, regionOffset, offset)
+}
+
+func nextDoc(data []byte, allocator Allocator, regionOffset, offset int) int {
+	end := regionOffset + entrySize
+	if offset < 0 {
+		offset = regionOffset
+	} else {
+		offset += slotSize(data, allocator, offset)
+	}
+	if offset >= end {
+		return -1
+	}
+
+	if allocator == AllocSlab {
+		c := slotClass(data[offset])
+		if c == 0 || c >= len(slabClasses) || offset+slabClasses[c] > end {
+			return -1
+		}
+	}
+	return offset
+}
+
+func (r *CacheImpl) docLen(offset int) (int, error) {
+	keyLen, err := binaryInt(r.mmap[offset+1 : offset+3])
+	if err != nil {
+		return 0, err
+	}
+	valLen, err := binaryInt(r.mmap[offset+3 : offset+5])
+	if err != nil {
+		return 0, err
+	}
+	return docHeaderLength + keyLen + valLen, nil
+}
+
+// 把doc写到alloc分配的位置上，slot的class保持不变，同时更新bucket的用量
+func (r *CacheImpl) writeDoc(offset int, doc []byte) error {
+	if r.isUsed(offset) {
+		if err := r.addUsage(offset, -1); err != nil {
+			return err
+		}
+	}
+	doc[0] = doc[0]&^docClassMask | docUsed | r.mmap[offset]&docClassMask
+	if err := r.write(offset, doc); err != nil {
+		return err
+	}
+	return r.addUsage(offset, 1)
+}
+
+// 在block j的region中分配一个能放下size大小doc的位置，没有空间返回-1
+// 空间不够时先释放region中FlushAll之前写入的doc
+func (r *CacheImpl) alloc(j, region, size int) (int, error) {
+	offset, err := r.allocFree(j, region, size)
+	if err != nil || offset >= 0 {
+		return offset, err
+	}
+	if freed, err := r.freeFlushed(j, region); err != nil || !freed {
+		return -1, err
+	}
+	return r.allocFree(j, region, size)
+}
+
+func (r *CacheImpl) allocFree(j, region, size int) (int, error) {
+	regionOffset := blockOffset(j) + region*entrySize
+	if r.layout.allocator != AllocSlab {
+		for i := 0; i < docCount; i++ {
+			if !r.isUsed(regionOffset + docLength*i) {
+				return regionOffset + docLength*i, nil
+			}
+		}
+		return -1, nil
+	}
+
+	offset, ok, err := r.slabAlloc(j, region, size)
+	if err == nil && !ok {
+		// 分配表和region中的slot对不上（比如写到一半的时候崩溃了），重建之后再试一次
+		if err = r.rebuildSlabRegion(j, region); err == nil {
+			offset, ok, err = r.slabAlloc(j, region, size)
+		}
+		if err == nil && !ok {
+			err = InvalidFileFormat
+		}
+	}
+	return offset, err
+}
+
+// 依次尝试：同样大小的空闲slot，未分配的部分，更大的空闲slot
+// 分配表和slot对不上时ok为false
+func (r *CacheImpl) slabAlloc(j, region, size int) (int, bool, error) {
+	regionOffset := blockOffset(j) + region*entrySize
+	entry := slabEntry(j, region)
+	class := slabClassOf(size)
+
+	offset, ok, err := r.slabPop(regionOffset, entry, class)
+	if err != nil || !ok || offset >= 0 {
+		return offset, ok, err
+	}
+
+	tail := int(r.headerUint16(entry))
+	if tail+slabClasses[class] <= entrySize {
+		offset = regionOffset + tail
+		if r.mmap[offset] != 0 {
+			return -1, false, nil
+		}
+		if err := r.write(offset, []byte{byte(class << 4)}); err != nil {
+			return -1, true, err
+		}
+		return offset, true, r.putSlabUint16(entry, tail+slabClasses[class])
+	}
+
+	for c := class + 1; c < len(slabClasses); c++ {
+		offset, ok, err := r.slabPop(regionOffset, entry, c)
+		if err != nil || !ok || offset >= 0 {
+			return offset, ok, err
+		}
+	}
+	return -1, true, nil
+}
+
+func (r *CacheImpl) slabPop(regionOffset, entry, class int) (int, bool, error) {
+	head := int(r.headerUint16(entry + 2*class))
+	if head == 0 {
+		return -1, true, nil
+	}
+
+	offset := regionOffset + head - 1
+	if head-1+slabClasses[class] > entrySize || r.mmap[offset] != byte(class<<4) {
+		return -1, false, nil
+	}
+	next := binary.LittleEndian.Uint16(r.mmap[offset+1 : offset+3])
+	return offset, true, r.putSlabUint16(entry+2*class, int(next))
+}
+
+// FlushAll之前写入的doc已经失效，可以当作空位使用
+func (r *CacheImpl) isFlushed(offset int) bool {
+	epoch := r.epoch()
+	if epoch == 0 || !r.isUsed(offset) {
+		return false
+	}
+	ext, _, err := r.docExtHeader(offset)
+	return err == nil && ext.epoch != epoch
+}
+
+// 释放region中所有FlushAll之前写入的doc，返回是否释放了
+func (r *CacheImpl) freeFlushed(j, region int) (bool, error) {
+	regionOffset := blockOffset(j) + region*entrySize
+	freed := false
+	for offset := r.nextDoc(regionOffset, -1); offset >= 0; offset = r.nextDoc(regionOffset, offset) {
+		if !r.isFlushed(offset) {
+			continue
+		}
+		if err := r.freeDoc(offset); err != nil {
+			return freed, err
+		}
+		freed = true
+	}
+	return freed, nil
+}
+
+// 删除doc，slab模式下slot放回空闲链表
+func (r *CacheImpl) freeDoc(offset int) error {
+	if r.isUsed(offset) {
+		if err := r.addUsage(offset, -1); err != nil {
+			return err
+		}
+	}
+	if r.layout.allocator != AllocSlab {
+		return r.write(offset, []byte{0})
+	}
+
+	j := (offset - headerSize) / bufSize
+	region := (offset - blockOffset(j)) / entrySize
+	regionOffset := blockOffset(j) + region*entrySize
+	entry := slabEntry(j, region)
+	class := slotClass(r.mmap[offset])
+
+	buf := make([]byte, 3)
+	buf[0] = byte(class << 4)
+	binary.LittleEndian.PutUint16(buf[1:], r.headerUint16(entry+2*class))
+	if err := r.write(offset, buf); err != nil {
+		return err
+	}
+	return r.putSlabUint16(entry+2*class, offset-regionOffset+1)
+}
+
+// slab模式下region中还没有分配出去的空间，放不下size大小的doc时返回0
+func (r *CacheImpl) slabTailFree(j, region, size int) int {
+	if r.layout.allocator != AllocSlab {
+		return 0
+	}
+	tail := int(r.headerUint16(slabEntry(j, region)))
+	if tail+slabClasses[slabClassOf(size)] > entrySize {
+		return 0
+	}
+	return entrySize - tail
+}
+
+func (r *CacheImpl) headerUint16(offset int) uint16 {
+	return binary.LittleEndian.Uint16(r.mmap[offset : offset+2])
+}
+
+// 分配表的修改也要经过write，事务回滚的时候才能一起回滚
+func (r *CacheImpl) putSlabUint16(offset, v int) error {
+	buf := make([]byte, 2)
+	binary.LittleEndian.PutUint16(buf, uint16(v))
+	return r.write(offset, buf)
+}
+
+// 根据region中的slot重建分配表，region中无法解析的部分会被清空
+func (r *CacheImpl) rebuildSlabRegion(j, region int) error {
+	regionOffset := blockOffset(j) + region*entrySize
+	end := regionOffset + entrySize
+
+	table := make([]byte, slabEntrySize)
+	offset := regionOffset
+	for ; offset < end; offset += slabClasses[slotClass(r.mmap[offset])] {
+		c := slotClass(r.mmap[offset])
+		if c == 0 || c >= len(slabClasses) || offset+slabClasses[c] > end {
+			break
+		}
+		if r.isUsed(offset) {
+			continue
+		}
+
+		buf := make([]byte, 3)
+		buf[0] = byte(c << 4)
+		copy(buf[1:], table[2*c:2*c+2])
+		if err := r.write(offset, buf); err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint16(table[2*c:], uint16(offset-regionOffset+1))
+	}
+	binary.LittleEndian.PutUint16(table, uint16(offset-regionOffset))
+
+	for i := offset; i < end; i++ {
+		if r.mmap[i] != 0 {
+			if err := r.write(offset, make([]byte, end-offset)); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	return r.write(slabEntry(j, region), table)
+}
+
+func (r *CacheImpl) rebuildSlab() error {
+	if r.layout.allocator != AllocSlab {
+		return nil
+	}
+	for j := 0; j < r.blocks(); j++ {
+		for region := 0; region < entryCount; region++ {
+			if err := r.rebuildSlabRegion(j, region); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package filecache_test
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Chyroc/filecache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlab(t *testing.T) {
+	as := assert.New(t)
+	defer os.Remove("./test-slab")
+
+	os.Remove("./test-slab")
+	c, err := filecache.Open("./test-slab", filecache.WithAllocator(filecache.AllocSlab))
+	as.Nil(err)
+
+	// 固定1280B的doc，3000个key就会扩容
+	for i := 0; i < 20000; i++ {
+		j := strconv.Itoa(i)
+		as.Nil(c.Set(j, j, time.Minute))
+	}
+	fi, err := os.Stat("./test-slab")
+	as.Nil(err)
+	as.Equal(int64(1048576+5242880), fi.Size())
+
+	// 原来的slot放不下，换一个位置
+	big := strings.Repeat("v", 1000)
+	for i := 0; i < 100; i++ {
+		as.Nil(c.Set(strconv.Itoa(i), big, time.Minute))
+	}
+	for i := 0; i < 200; i++ {
+		j := strconv.Itoa(i)
+		v, err := c.Get(j)
+		as.Nil(err)
+		if i < 100 {
+			as.Equal(big, v)
+		} else {
+			as.Equal(j, v)
+		}
+	}
+
+	// 删除之后空出来的slot可以再用
+	for round := 0; round < 5; round++ {
+		for i := 20000; i < 25000; i++ {
+			j := strconv.Itoa(i)
+			as.Nil(c.Set(j, j, time.Minute))
+		}
+		for i := 20000; i < 25000; i++ {
+			as.Nil(c.Del(strconv.Itoa(i)))
+		}
+	}
+	fi, err = os.Stat("./test-slab")
+	as.Nil(err)
+	as.Equal(int64(1048576+5242880), fi.Size())
+
+	// 事务回滚的时候分配表也要回滚
+	txn := c.Begin()
+	for i := 30000; i < 30100; i++ {
+		j := strconv.Itoa(i)
+		txn.Set(j, j, time.Minute)
+	}
+	txn.Expire("not-exist", time.Minute)
+	as.Equal(filecache.NotFound, txn.Commit())
+	_, err = c.Get("30000")
+	as.Equal(filecache.NotFound, err)
+
+	as.Nil(c.Del("1"))
+	_, err = c.Get("1")
+	as.Equal(filecache.NotFound, err)
+	as.Nil(c.Compact())
+	as.Nil(c.Close())
+
+	report, err := filecache.Check("./test-slab")
+	as.Nil(err)
+	as.True(report.OK(), "%v", report.Problems)
+	as.Equal(19999, report.Docs)
+
+	// 以文件中记录的为准
+	c, err = filecache.Open("./test-slab")
+	as.Nil(err)
+	defer c.Close()
+	v, err := c.Get("19999")
+	as.Nil(err)
+	as.Equal("19999", v)
+	v, err = c.Get("2")
+	as.Nil(err)
+	as.Equal(big, v)
+}
@@ -0,0 +1,220 @@
+package filecache
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+)
+
+type SnapshotMode int
+
+const (
+	SnapshotLive SnapshotMode = iota // 只保存没有过期的数据，宽限期内的也会保存
+	SnapshotRaw                      // 整个文件原样保存，本身就是一个可以直接打开的缓存文件
+)
+
+// live模式的快照是 magic(8) + 每个kv一条和wal一样的记录
+const snapshotMagic = "FCSNAPSH"
+
+// Snapshot 在持有锁的情况下写出快照，不会读到写了一半的doc
+// 开启了wal的时候还会持有wal文件上的锁，拷贝的过程中其他进程也不能修改
+// live模式的快照是明文，加密的文件需要加密快照时使用raw模式
+func (r *CacheImpl) Snapshot(w io.Writer, mode SnapshotMode) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.err != nil {
+		return r.err
+	}
+	if r.wal != nil {
+		if err := r.wal.lock(); err != nil {
+			return err
+		}
+		defer r.wal.unlock()
+	}
+
+	if mode == SnapshotRaw {
+		_, err := w.Write(r.mmap)
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(snapshotMagic); err != nil {
+		return err
+	}
+	// 先写bucket，恢复的时候bucket的id保持不变
+	for _, o := range r.buckets() {
+		if _, err := bw.Write(encodeRecord([]*op{o})); err != nil {
+			return err
+		}
+	}
+	err := r.scan(func(kv *kv) error {
+		if kv.reclaimable() {
+			return nil
+		}
+		_, err := bw.Write(encodeRecord([]*op{{kind: opSet, key: kv.key, val: kv.val, expiredAt: int64(kv.expiredAt), grace: int64(kv.grace), ns: byte(kv.ns)}}))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// SnapshotTo 先写到临时文件，再rename到path
+func (r *CacheImpl) SnapshotTo(path string, mode SnapshotMode) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	if err := r.Snapshot(f, mode); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// Restore 用快照替换当前的全部数据，两种模式的快照都可以
+// 其他进程如果也打开了这个文件，需要重新打开才能看到恢复后的数据
+func (r *CacheImpl) Restore(rd io.Reader) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return r.err
+	}
+
+	tmp := r.filepath + ".restore"
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+
+	br := bufio.NewReader(rd)
+	magic, err := br.Peek(len(headerMagic))
+	if err != nil {
+		return InvalidFileFormat
+	}
+
+	switch {
+	case bytes.Equal(magic, []byte(headerMagic)):
+		if err := restoreRaw(tmp, br, r.fileOptions()); err != nil {
+			return err
+		}
+	case bytes.Equal(magic, []byte(snapshotMagic)):
+		if _, err := br.Discard(len(snapshotMagic)); err != nil {
+			return err
+		}
+		if err := restoreLive(tmp, br, r.fileOptions()); err != nil {
+			return err
+		}
+	default:
+		return InvalidFileFormat
+	}
+
+	return r.replaceFile(tmp)
+}
+
+func restoreRaw(path string, rd io.Reader, opts []Option) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, rd); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	// 打开一次，检查文件格式和加密的key，并回滚没有完成的事务
+	c, err := open(path, opts)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	return c.Close()
+}
+
+func restoreLive(path string, rd io.Reader, opts []Option) error {
+	c, err := open(path, opts)
+	if err != nil {
+		return err
+	}
+
+	now := unixMs(0)
+	for {
+		ops, err := readRecord(rd)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			c.Close()
+			return err
+		}
+
+		for _, o := range ops {
+			if o.kind == opBucket {
+				if err := c.putBucket(o); err != nil {
+					c.Close()
+					return err
+				}
+				continue
+			}
+			if o.kind != opSet || o.expiredAt+o.grace < now {
+				continue
+			}
+			if err := c.set(o); err != nil {
+				c.Close()
+				return err
+			}
+		}
+	}
+
+	return c.Close()
+}
+
+// 和当前的文件使用同样的layout、压缩方式和加密的key
+func (r *CacheImpl) fileOptions() []Option {
+	opts := append(r.layout.options(), WithCompression(r.options.compression, r.options.compressionThreshold))
+	if r.encryption != nil {
+		opts = append(opts, WithEncryption(r.options.encryptionKey, r.encryption.hashKeys))
+	}
+	return opts
+}
+
+// 用path替换当前的文件并重新加载
+func (r *CacheImpl) replaceFile(path string) error {
+	if r.err = r.mmap.Unmap(); r.err != nil {
+		return r.err
+	}
+	if r.err = r.file.Close(); r.err != nil {
+		return r.err
+	}
+	if r.err = os.Rename(path, r.filepath); r.err != nil {
+		return r.err
+	}
+
+	r.file, r.err = os.OpenFile(r.filepath, os.O_RDWR, 0600)
+	if r.err != nil {
+		return r.err
+	}
+	if err := r.loadFile(); err != nil {
+		return err
+	}
+	r.indexReset()
+
+	// wal里的记录是恢复之前的，不能再回放了
+	return r.lockedCheckpoint()
+}
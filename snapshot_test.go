@@ -0,0 +1,116 @@
+package filecache_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Chyroc/filecache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	as := assert.New(t)
+	defer os.Remove("./test-snapshot")
+	defer os.Remove("./test-snapshot.raw")
+
+	os.Remove("./test-snapshot")
+	c, err := filecache.Open("./test-snapshot")
+	as.Nil(err)
+
+	as.Nil(c.Set("a", "1", time.Minute))
+	as.Nil(c.Set("b", "2", time.Minute))
+	as.Nil(c.Set("expired", "3", time.Millisecond))
+	time.Sleep(time.Millisecond * 2)
+
+	t.Run("live", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		as.Nil(c.Snapshot(buf, filecache.SnapshotLive))
+
+		as.Nil(c.Del("a"))
+		as.Nil(c.Set("c", "3", time.Minute))
+
+		as.Nil(c.Restore(buf))
+
+		kvs, err := c.Range()
+		as.Nil(err)
+		as.Len(kvs, 2)
+		for _, kv := range kvs {
+			as.True(kv.TTL > 0 && kv.TTL <= time.Minute)
+		}
+		v, err := c.Get("a")
+		as.Nil(err)
+		as.Equal("1", v)
+		_, err = c.Get("c")
+		as.Equal(filecache.NotFound, err)
+	})
+
+	t.Run("raw", func(t *testing.T) {
+		as.Nil(c.SnapshotTo("./test-snapshot.raw", filecache.SnapshotRaw))
+
+		raw, err := filecache.Open("./test-snapshot.raw")
+		as.Nil(err)
+		v, err := raw.Get("b")
+		as.Nil(err)
+		as.Equal("2", v)
+		as.Nil(raw.Close())
+
+		as.Nil(c.Del("b"))
+
+		f, err := os.Open("./test-snapshot.raw")
+		as.Nil(err)
+		defer f.Close()
+		as.Nil(c.Restore(f))
+
+		v, err = c.Get("b")
+		as.Nil(err)
+		as.Equal("2", v)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		as.Equal(filecache.InvalidFileFormat, c.Restore(bytes.NewBufferString("not a snapshot")))
+
+		v, err := c.Get("b")
+		as.Nil(err)
+		as.Equal("2", v)
+	})
+	t.Run("wal lock", func(t *testing.T) {
+		defer os.Remove("./test-snapshot-wal")
+		defer os.Remove("./test-snapshot-wal.wal")
+		os.Remove("./test-snapshot-wal")
+		os.Remove("./test-snapshot-wal.wal")
+		c, err := filecache.Open("./test-snapshot-wal", filecache.WithWAL(filecache.SyncNever))
+		as.Nil(err)
+		defer c.Close()
+		// 另一个进程打开同一个文件
+		other, err := filecache.Open("./test-snapshot-wal", filecache.WithWAL(filecache.SyncNever))
+		as.Nil(err)
+		defer other.Close()
+
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		go func() {
+			pw.CloseWithError(c.Snapshot(pw, filecache.SnapshotRaw))
+		}()
+		// 读到数据的时候Snapshot已经拿到了wal的锁，拷贝完之前其他进程不能写入
+		_, err = io.ReadFull(pr, make([]byte, 1))
+		as.Nil(err)
+		done := make(chan error, 1)
+		go func() {
+			done <- other.Set("k", "v", time.Minute)
+		}()
+		select {
+		case err := <-done:
+			as.Fail("Set did not wait for Snapshot", "%v", err)
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		_, err = io.Copy(ioutil.Discard, pr)
+		as.Nil(err)
+		as.Nil(<-done)
+	})
+}
@@ -0,0 +1,59 @@
+package filecache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SetWithGrace 和Set一样，ttl之后Get读不到，但是之后的grace时间内可以用GetStale读到旧的值
+// 过了ttl+grace之后才会被Range、Compact清理，grace小于等于0时和Set一样
+func (r *CacheImpl) SetWithGrace(key, val string, ttl, grace time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	o := &op{kind: opSet, key: key, val: val, expiredAt: unixMs(ttl)}
+	if grace > 0 {
+		o.grace = int64(grace / time.Millisecond)
+	}
+	return r.mutate([]*op{o})
+}
+
+// GetStale 和Get一样，但是宽限期内的数据也会返回，此时stale为true
+// 用于上游不可用的时候返回旧的数据
+func (r *CacheImpl) GetStale(key string) (val string, stale bool, err error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	kv, err := r.find(0, key)
+	if err == nil && kv.reclaimable() {
+		err = NotFound
+	}
+	r.countGet(err)
+	if err != nil {
+		return "", false, err
+	}
+	return kv.val, kv.ttl < 0, nil
+}
+
+// 过了硬过期时间，可以回收了
+func (k *kv) reclaimable() bool {
+	return k.flushed || k.ttl+k.grace < 0
+}
+
+// 删除可以回收的doc
+// 有进程在接收过期通知时先放到队列中
+func (r *CacheImpl) reclaim(kv *kv) error {
+	if !kv.flushed {
+		if err := r.notifyExpired(kv.offset); err != nil {
+			return err
+		}
+	}
+	if err := r.freeDoc(kv.offset); err != nil {
+		return err
+	}
+	r.indexDel(kv.ns, kv.rawKey)
+	if !kv.flushed {
+		atomic.AddUint64(&r.stats.expirations, 1)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package filecache_test
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Chyroc/filecache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetStale(t *testing.T) {
+	as := assert.New(t)
+	defer os.Remove("./test-stale")
+	os.Remove("./test-stale")
+
+	c, err := filecache.Open("./test-stale", filecache.WithWAL(filecache.SyncNever))
+	as.Nil(err)
+	defer c.Close()
+	defer os.Remove("./test-stale.wal")
+
+	t.Run("fresh", func(t *testing.T) {
+		as.Nil(c.SetWithGrace("fresh", "v", time.Minute, time.Minute))
+		v, stale, err := c.GetStale("fresh")
+		as.Nil(err)
+		as.Equal("v", v)
+		as.False(stale)
+
+		v, err = c.Get("fresh")
+		as.Nil(err)
+		as.Equal("v", v)
+		ttl, err := c.TTL("fresh")
+		as.Nil(err)
+		as.True(ttl <= time.Minute && ttl > time.Minute-time.Second)
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		as.Nil(c.SetWithGrace("stale", "v", 50*time.Millisecond, time.Minute))
+		time.Sleep(100 * time.Millisecond)
+
+		_, err := c.Get("stale")
+		as.Equal(filecache.NotFound, err)
+		_, err = c.TTL("stale")
+		as.Equal(filecache.NotFound, err)
+
+		v, stale, err := c.GetStale("stale")
+		as.Nil(err)
+		as.Equal("v", v)
+		as.True(stale)
+
+		// 宽限期内不会被清理，Range也看不到
+		kvs, err := c.Range()
+		as.Nil(err)
+		for _, kv := range kvs {
+			as.NotEqual("stale", kv.Key)
+		}
+		as.Nil(c.Compact())
+		_, _, err = c.GetStale("stale")
+		as.Nil(err)
+	})
+
+	t.Run("hard expired", func(t *testing.T) {
+		as.Nil(c.SetWithGrace("hard", "v", 20*time.Millisecond, 30*time.Millisecond))
+		as.Nil(c.Set("plain", "v", 20*time.Millisecond))
+		time.Sleep(100 * time.Millisecond)
+
+		_, _, err := c.GetStale("hard")
+		as.Equal(filecache.NotFound, err)
+		_, _, err = c.GetStale("plain")
+		as.Equal(filecache.NotFound, err)
+	})
+
+	t.Run("expire keeps grace", func(t *testing.T) {
+		as.Nil(c.SetWithGrace("expire", "v", time.Minute, time.Minute))
+		as.Nil(c.Expire("expire", 20*time.Millisecond))
+		time.Sleep(50 * time.Millisecond)
+
+		v, stale, err := c.GetStale("expire")
+		as.Nil(err)
+		as.Equal("v", v)
+		as.True(stale)
+	})
+
+	t.Run("snapshot", func(t *testing.T) {
+		var buf bytes.Buffer
+		as.Nil(c.Snapshot(&buf, filecache.SnapshotLive))
+		as.Nil(c.Restore(&buf))
+
+		v, stale, err := c.GetStale("stale")
+		as.Nil(err)
+		as.Equal("v", v)
+		as.True(stale)
+	})
+
+	t.Run("check", func(t *testing.T) {
+		as.Nil(c.Checkpoint())
+		report, err := filecache.Check("./test-stale")
+		as.Nil(err)
+		as.True(report.OK(), "%v", report.Problems)
+	})
+}
@@ -0,0 +1,193 @@
+package filecache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// 进程内的计数，不会写到文件中
+type stats struct {
+	bloomChecks         uint64
+	bloomNegatives      uint64
+	bloomFalsePositives uint64
+	uncompressedBytes   uint64
+	compressedBytes     uint64
+	hits                uint64
+	misses              uint64
+	expirations         uint64
+	evictions           uint64
+	hashConflicts       uint64
+	expireDropped       uint64
+	refreshErrors       uint64
+}
+
+type Stats struct {
+	BloomChecks         uint64 // 查询bloom filter的次数
+	BloomNegatives      uint64 // bloom filter确定key不在block中的次数
+	BloomFalsePositives uint64 // bloom filter认为可能在，实际上不在的次数
+	UncompressedBytes   uint64 // 超过压缩阈值的value压缩前的总长度
+	CompressedBytes     uint64 // 这些value实际写入的总长度
+	Hits                uint64 // Get、GetStale、GetOrLoad读到数据的次数
+	Misses              uint64 // 读不到的次数
+	Expirations         uint64 // 清理掉的过期数据的数量
+	Evictions           uint64 // 没有过期就被FlushAll、Bucket.Flush删掉的数据的数量，空间不够时不会淘汰数据
+	HashConflicts       uint64 // Set时key能用的region在所有block中都满了的次数，会扩容，已经最大时写入失败
+	ExpireDropped       uint64 // 过期通知的队列满了，没有通知就清理掉的数据的数量
+	RefreshErrors       uint64 // WithStaleWhileRevalidate在后台重新加载失败的次数，包括loader panic
+
+	// 下面是打开Stats时文件中的情况，所有进程写入的数据都算
+	Len            int           // 同Len()
+	Entries        int           // 没有过期的数据的数量
+	Stale          int           // 过了ttl、还在宽限期内的数据的数量
+	Expired        int           // 已经过期（包括FlushAll之前写入的）、还没有被清理的数据的数量
+	UsedBytes      int64         // 所有doc的长度
+	AllocatedBytes int64         // 这些doc占用的空间，slab模式下是slot的大小，否则每个doc都是1280B
+	FileSize       int64         // 包括header
+	Blocks         int           // block的数量
+	BlockFill      []float64     // 每个block已经分配出去的比例
+	RegionFill     [11]int       // region已经分配出去的比例的分布，下标i是比例在[i*10%, (i+1)*10%)的region的数量，最后一个是满了的
+	Elapsed        time.Duration // 统计文件中的情况花的时间
+}
+
+// BloomFalsePositiveRate 不存在的key被bloom filter误判为可能存在的比例
+func (s *Stats) BloomFalsePositiveRate() float64 {
+	if s.BloomNegatives+s.BloomFalsePositives == 0 {
+		return 0
+	}
+	return float64(s.BloomFalsePositives) / float64(s.BloomNegatives+s.BloomFalsePositives)
+}
+
+// CompressionRatio 超过压缩阈值的value压缩前后的长度之比
+func (s *Stats) CompressionRatio() float64 {
+	if s.CompressedBytes == 0 {
+		return 0
+	}
+	return float64(s.UncompressedBytes) / float64(s.CompressedBytes)
+}
+
+func (s *Stats) HitRatio() float64 {
+	return ratio(s.Hits, s.Misses)
+}
+
+// Stats 返回进程内的计数，以及遍历一遍文件中的doc得到的用量，遍历不会解码value
+func (r *CacheImpl) Stats() *Stats {
+	s := r.counters()
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.err == nil {
+		r.fileStats(s)
+	}
+	return s
+}
+
+// HeaderStats 和Stats一样，但是不遍历文件，文件中的情况只有header中记录了的Len、UsedBytes、FileSize、Blocks，其他的都是0
+func (r *CacheImpl) HeaderStats() *Stats {
+	s := r.counters()
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.err == nil {
+		s.Len = r.length()
+		for ns := 0; ns < maxBuckets; ns++ {
+			s.UsedBytes += int64(r.headerUint64(bucketEntry(ns) + bucketBytes))
+		}
+		s.FileSize = r.fileStat.Size()
+		s.Blocks = r.blocks()
+	}
+	return s
+}
+
+func (r *CacheImpl) counters() *Stats {
+	return &Stats{
+		BloomChecks:         atomic.LoadUint64(&r.stats.bloomChecks),
+		BloomNegatives:      atomic.LoadUint64(&r.stats.bloomNegatives),
+		BloomFalsePositives: atomic.LoadUint64(&r.stats.bloomFalsePositives),
+		UncompressedBytes:   atomic.LoadUint64(&r.stats.uncompressedBytes),
+		CompressedBytes:     atomic.LoadUint64(&r.stats.compressedBytes),
+		Hits:                atomic.LoadUint64(&r.stats.hits),
+		Misses:              atomic.LoadUint64(&r.stats.misses),
+		Expirations:         atomic.LoadUint64(&r.stats.expirations),
+		Evictions:           atomic.LoadUint64(&r.stats.evictions),
+		HashConflicts:       atomic.LoadUint64(&r.stats.hashConflicts),
+		ExpireDropped:       atomic.LoadUint64(&r.stats.expireDropped),
+		RefreshErrors:       atomic.LoadUint64(&r.stats.refreshErrors),
+	}
+}
+
+func (r *CacheImpl) fileStats(s *Stats) {
+	start := time.Now()
+	now := int(unixMs(0))
+	epoch := r.epoch()
+
+	s.Len = r.length()
+	s.FileSize = r.fileStat.Size()
+	s.Blocks = r.blocks()
+	s.BlockFill = make([]float64, s.Blocks)
+	for j := 0; j < s.Blocks; j++ {
+		blockUsed := 0
+		for region := 0; region < entryCount; region++ {
+			regionOffset := blockOffset(j) + region*entrySize
+			used := 0
+			for offset := r.nextDoc(regionOffset, -1); offset >= 0; offset = r.nextDoc(regionOffset, offset) {
+				if !r.isUsed(offset) {
+					continue
+				}
+				used += r.slotSize(offset)
+
+				ext, size, err := r.docExtHeader(offset)
+				if err != nil {
+					continue
+				}
+				expiredAt, err := binaryInt(r.mmap[offset+5 : offset+docHeaderLength])
+				if err != nil {
+					continue
+				}
+				s.UsedBytes += int64(size)
+				switch {
+				case ext.epoch != epoch || expiredAt < now:
+					s.Expired++
+				case expiredAt-ext.grace < now:
+					s.Stale++
+				default:
+					s.Entries++
+				}
+			}
+			s.AllocatedBytes += int64(used)
+			s.RegionFill[used*10/entrySize]++
+			blockUsed += used
+		}
+		s.BlockFill[j] = float64(blockUsed) / float64(bufSize)
+	}
+	s.Elapsed = time.Since(start)
+}
+
+// Len 文件中数据的数量，包括所有bucket中的，以及已经过期、还没有被清理的，不需要遍历文件
+func (r *CacheImpl) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.err != nil {
+		return 0
+	}
+	return r.length()
+}
+
+func (r *CacheImpl) length() int {
+	n := 0
+	for ns := 0; ns < maxBuckets; ns++ {
+		n += int(r.headerUint64(bucketEntry(ns) + bucketKeys))
+	}
+	return n
+}
+
+// 读操作的命中计数
+func (r *CacheImpl) countGet(err error) {
+	if err == nil {
+		atomic.AddUint64(&r.stats.hits, 1)
+	} else if err == NotFound {
+		atomic.AddUint64(&r.stats.misses, 1)
+	}
+}
@@ -0,0 +1,106 @@
+package filecache_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Chyroc/filecache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStats(t *testing.T) {
+	as := assert.New(t)
+	defer os.Remove("./test-stats")
+	os.Remove("./test-stats")
+
+	c, err := filecache.Open("./test-stats")
+	as.Nil(err)
+	defer c.Close()
+
+	t.Run("len", func(t *testing.T) {
+		as.Equal(0, c.Len())
+		as.Nil(c.Set("k1", "v", time.Minute))
+		as.Nil(c.Set("k2", "v", time.Minute))
+		as.Nil(c.Set("k2", "v2", time.Minute))
+		b, err := c.Bucket("b")
+		as.Nil(err)
+		as.Nil(b.Set("k1", "v", time.Minute))
+		as.Equal(3, c.Len())
+
+		as.Nil(c.Del("k1"))
+		as.Equal(2, c.Len())
+	})
+
+	t.Run("entries", func(t *testing.T) {
+		as.Nil(c.Set("expired", "v", 10*time.Millisecond))
+		as.Nil(c.SetWithGrace("stale", "v", 10*time.Millisecond, time.Minute))
+		time.Sleep(20 * time.Millisecond)
+
+		s := c.Stats()
+		as.Equal(4, s.Len)
+		as.Equal(2, s.Entries)
+		as.Equal(1, s.Stale)
+		as.Equal(1, s.Expired)
+		as.Equal(1, s.Blocks)
+		as.Len(s.BlockFill, 1)
+		as.Equal(int64(4*1280), s.AllocatedBytes)
+		as.True(s.UsedBytes > 0 && s.UsedBytes < s.AllocatedBytes)
+		as.Equal(int64(1048576+5242880), s.FileSize)
+		sum := 0
+		for _, n := range s.RegionFill {
+			sum += n
+		}
+		as.Equal(512, sum)
+
+		// header中的计数和遍历得到的一样
+		h := c.HeaderStats()
+		as.Equal(s.Len, h.Len)
+		as.Equal(s.UsedBytes, h.UsedBytes)
+		as.Equal(s.FileSize, h.FileSize)
+		as.Equal(s.Blocks, h.Blocks)
+		as.Equal(0, h.Entries)
+		as.Nil(h.BlockFill)
+	})
+
+	t.Run("counters", func(t *testing.T) {
+		_, err := c.Get("k2")
+		as.Nil(err)
+		_, err = c.Get("expired")
+		as.Equal(filecache.NotFound, err)
+		_, _, err = c.GetStale("stale")
+		as.Nil(err)
+
+		s := c.Stats()
+		as.Equal(uint64(2), s.Hits)
+		as.Equal(uint64(1), s.Misses)
+		as.Equal(2.0/3, s.HitRatio())
+
+		_, err = c.Range()
+		as.Nil(err)
+		s = c.Stats()
+		as.Equal(uint64(1), s.Expirations)
+		as.Equal(0, s.Expired)
+		as.Equal(3, c.Len())
+
+		as.Nil(c.FlushAll(false))
+		s = c.Stats()
+		as.Equal(uint64(3), s.Evictions)
+		as.Equal(0, s.Len)
+		as.Equal(3, s.Expired)
+	})
+
+	t.Run("hash conflicts", func(t *testing.T) {
+		for i := 0; i < 5000; i++ {
+			as.Nil(c.Set(fmt.Sprintf("key-%d", i), "v", time.Minute))
+		}
+		s := c.Stats()
+		as.True(s.HashConflicts > 0)
+		as.True(s.Blocks >= 2)
+		as.Len(s.BlockFill, s.Blocks)
+		as.Equal(5000, s.Entries)
+		as.Equal(5000, s.Len)
+		as.True(s.BlockFill[0] > s.BlockFill[1])
+	})
+}
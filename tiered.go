@@ -0,0 +1,406 @@
+package filecache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// TieredMode 决定TieredCache的Set什么时候写到文件中
+type TieredMode int
+
+const (
+	WriteThrough TieredMode = iota // 先写文件，再写内存
+	WriteBack                      // 只写内存，被淘汰、Flush或者Close的时候再写到文件中，进程崩溃会丢失
+)
+
+type TieredOption func(*tieredOptions)
+
+type tieredOptions struct {
+	mode       TieredMode
+	maxEntries int
+	maxBytes   int
+}
+
+// WithL1MaxEntries 内存中最多保存多少个key，0表示不限制
+func WithL1MaxEntries(n int) TieredOption {
+	return func(o *tieredOptions) {
+		o.maxEntries = n
+	}
+}
+
+// WithL1MaxBytes 内存中key和value的总长度上限，0表示不限制
+func WithL1MaxBytes(n int) TieredOption {
+	return func(o *tieredOptions) {
+		o.maxBytes = n
+	}
+}
+
+func WithTieredMode(mode TieredMode) TieredOption {
+	return func(o *tieredOptions) {
+		o.mode = mode
+	}
+}
+
+// TieredCache 在文件缓存(L2)前面加一层进程内的LRU(L1)
+// 文件的seq和上次看到的不一样时（其他进程或者直接通过L2修改了文件），L1中没有写回的数据以外都会失效
+// Del和Expire总是同时修改L1和L2
+type TieredCache struct {
+	mu      sync.Mutex // 保护L1，L2的操作也在锁里面做，保证L1和L2的修改顺序一致
+	l2      *CacheImpl
+	options tieredOptions
+	lru     *list.List // 前面是最近使用的
+	entries map[string]*list.Element
+	bytes   int
+	seq     uint64
+	stats   TieredStats
+	onEvict evictHooks
+	evicted []EvictedEvent // 从L1中淘汰了还没有通知的数据
+}
+
+type tieredEntry struct {
+	key       string
+	val       string
+	expiredAt int64 // ms
+	dirty     bool  // 还没有写回L2
+}
+
+func (e *tieredEntry) size() int {
+	return len(e.key) + len(e.val)
+}
+
+type TieredStats struct {
+	L1Hits        uint64
+	L1Misses      uint64
+	L2Hits        uint64
+	L2Misses      uint64
+	Evictions     uint64 // 因为超过容量被淘汰的次数
+	Invalidations uint64 // 文件被修改导致L1失效的次数
+	WriteBacks    uint64 // 写回L2的key的数量
+}
+
+// L1HitRatio 所有的Get中L1命中的比例
+func (s *TieredStats) L1HitRatio() float64 {
+	return ratio(s.L1Hits, s.L1Misses)
+}
+
+// L2HitRatio L1没有命中的Get中L2命中的比例
+func (s *TieredStats) L2HitRatio() float64 {
+	return ratio(s.L2Hits, s.L2Misses)
+}
+
+// HitRatio 所有的Get中L1或者L2命中的比例
+func (s *TieredStats) HitRatio() float64 {
+	return ratio(s.L1Hits+s.L2Hits, s.L2Misses)
+}
+
+func ratio(hits, misses uint64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// NewTiered 之后l2由TieredCache管理，Close的时候会一起关闭
+func NewTiered(l2 *CacheImpl, opts ...TieredOption) *TieredCache {
+	t := &TieredCache{
+		l2:      l2,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+	for _, opt := range opts {
+		opt(&t.options)
+	}
+	return t
+}
+
+func (t *TieredCache) Get(key string) (string, error) {
+	t.mu.Lock()
+	defer t.unlock()
+
+	var l1 *tieredEntry
+	var l2 *kv
+	err := t.l2do(false, func() (err error) {
+		if l1 = t.lookup(key); l1 != nil {
+			return nil
+		}
+		l2, err = t.l2.get(0, key)
+		return err
+	})
+	if l1 != nil {
+		t.stats.L1Hits++
+		return l1.val, nil
+	}
+	t.stats.L1Misses++
+	if err == NotFound {
+		t.stats.L2Misses++
+		return "", err
+	} else if err != nil {
+		return "", err
+	}
+
+	t.stats.L2Hits++
+	t.add(&tieredEntry{key: key, val: l2.val, expiredAt: int64(l2.expiredAt)})
+	// 写回失败的数据还在L1中，之后的Set、Flush、Close会再写，Get不用返回这个错误
+	_ = t.evict()
+	return l2.val, nil
+}
+
+func (t *TieredCache) Set(key, val string, ttl time.Duration) error {
+	t.mu.Lock()
+	defer t.unlock()
+
+	e := &tieredEntry{key: key, val: val, expiredAt: unixMs(ttl)}
+	o := &op{kind: opSet, key: key, val: val, expiredAt: e.expiredAt}
+	err := t.l2do(true, func() error {
+		if t.options.mode == WriteBack {
+			// 不写L2，但是要和L2一样检查
+			e.dirty = true
+			return o.check(t.l2.maxLengthValue())
+		}
+		return t.l2.mutate([]*op{o})
+	})
+	if err != nil {
+		t.remove(key)
+		return err
+	}
+
+	t.add(e)
+	return t.evict()
+}
+
+func (t *TieredCache) TTL(key string) (time.Duration, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var ttl time.Duration
+	err := t.l2do(false, func() error {
+		if e := t.lookup(key); e != nil {
+			ttl = time.Duration(e.expiredAt-unixMs(0)) * time.Millisecond
+			return nil
+		}
+		kv, err := t.l2.get(0, key)
+		if err != nil {
+			return err
+		}
+		ttl = time.Duration(kv.ttl) * time.Millisecond
+		return nil
+	})
+	return ttl, err
+}
+
+func (t *TieredCache) Expire(key string, ttl time.Duration) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	expiredAt := unixMs(ttl)
+	return t.l2do(true, func() error {
+		e := t.lookup(key)
+		if e != nil && e.dirty {
+			e.expiredAt = expiredAt
+			return nil
+		}
+		if err := t.l2.mutate([]*op{{kind: opExpire, key: key, expiredAt: expiredAt}}); err != nil {
+			t.remove(key)
+			return err
+		}
+		if e != nil {
+			e.expiredAt = expiredAt
+		}
+		return nil
+	})
+}
+
+func (t *TieredCache) Del(key string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.remove(key)
+	return t.l2do(true, func() error {
+		return t.l2.mutate([]*op{{kind: opDel, key: key}})
+	})
+}
+
+// Range 先把L1中的数据写回，再遍历L2
+func (t *TieredCache) Range() ([]*KV, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.flush(); err != nil {
+		return nil, err
+	}
+	var kvs []*KV
+	err := t.l2do(true, func() (err error) {
+		kvs, err = t.l2.rangeKV(context.Background(), 0)
+		return err
+	})
+	return kvs, err
+}
+
+// Flush 把L1中还没有写回的数据写到L2，在一个事务中完成
+func (t *TieredCache) Flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.flush()
+}
+
+// Close 写回L1中的数据之后关闭L2，写回失败时L2也会关闭，返回写回的错误
+func (t *TieredCache) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	err := t.flush()
+	t.lru.Init()
+	t.entries = make(map[string]*list.Element)
+	t.bytes = 0
+	if cerr := t.l2.Close(); err == nil || err == Closed {
+		err = cerr
+	}
+	return err
+}
+
+func (t *TieredCache) Stats() *TieredStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := t.stats
+	return &stats
+}
+
+// 淘汰L1的时候调用onEvict，L2的FlushAll、Bucket.Flush和过期通知注册到L2上
+func (t *TieredCache) addHooks(onEvict func(EvictedEvent), onExpire func(ExpiredEvent)) {
+	if onEvict != nil {
+		t.onEvict.add(onEvict)
+	}
+	t.l2.addHooks(onEvict, onExpire)
+}
+
+// 释放t.mu之后再通知淘汰的数据，hook中可以再操作TieredCache
+func (t *TieredCache) unlock() {
+	evicted := t.evicted
+	t.evicted = nil
+	t.mu.Unlock()
+	t.onEvict.notify(evicted)
+}
+
+// 在L2的锁中执行fn，执行之前检查文件有没有被修改过，执行之后记录新的seq
+func (t *TieredCache) l2do(write bool, fn func() error) error {
+	r := t.l2
+	if write {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+	} else {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+	}
+
+	if r.err != nil {
+		return r.err
+	}
+	if seq := r.headerUint64(metaSeq); seq != t.seq {
+		t.invalidate()
+		t.seq = seq
+	}
+	err := fn()
+	t.seq = r.headerUint64(metaSeq)
+	return err
+}
+
+// 返回没有过期的entry，并移到最前面
+func (t *TieredCache) lookup(key string) *tieredEntry {
+	el, ok := t.entries[key]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*tieredEntry)
+	if e.expiredAt < unixMs(0) {
+		// 过期了，没有写回的也不需要再写回
+		t.removeElement(el)
+		return nil
+	}
+	t.lru.MoveToFront(el)
+	return e
+}
+
+func (t *TieredCache) add(e *tieredEntry) {
+	t.remove(e.key)
+	t.entries[e.key] = t.lru.PushFront(e)
+	t.bytes += e.size()
+}
+
+func (t *TieredCache) remove(key string) {
+	if el, ok := t.entries[key]; ok {
+		t.removeElement(el)
+	}
+}
+
+func (t *TieredCache) removeElement(el *list.Element) {
+	e := t.lru.Remove(el).(*tieredEntry)
+	delete(t.entries, e.key)
+	t.bytes -= e.size()
+}
+
+// 超过容量时从后面开始淘汰，没有写回的数据写到L2之后才从L1中删除，写回失败的留在L1中，下次再写
+func (t *TieredCache) evict() error {
+	for t.lru.Len() > 0 && (t.options.maxEntries > 0 && t.lru.Len() > t.options.maxEntries || t.options.maxBytes > 0 && t.bytes > t.options.maxBytes) {
+		// 写回的时候文件变了会让L1失效，每次都重新取最后一个
+		el := t.lru.Back()
+		e := el.Value.(*tieredEntry)
+		if e.dirty {
+			if err := t.writeBack([]*tieredEntry{e}); err != nil {
+				return err
+			}
+		}
+		if !t.onEvict.empty() {
+			t.evicted = append(t.evicted, EvictedEvent{Key: e.key, Val: e.val})
+		}
+		t.removeElement(el)
+		t.stats.Evictions++
+	}
+	return nil
+}
+
+// 文件被修改了，丢掉L1中除了没有写回的数据以外的所有数据
+func (t *TieredCache) invalidate() {
+	if t.lru.Len() == 0 {
+		return
+	}
+	for el := t.lru.Front(); el != nil; {
+		next := el.Next()
+		if !el.Value.(*tieredEntry).dirty {
+			t.removeElement(el)
+		}
+		el = next
+	}
+	t.stats.Invalidations++
+}
+
+func (t *TieredCache) flush() error {
+	var dirty []*tieredEntry
+	for el := t.lru.Front(); el != nil; el = el.Next() {
+		if e := el.Value.(*tieredEntry); e.dirty {
+			dirty = append(dirty, e)
+		}
+	}
+	return t.writeBack(dirty)
+}
+
+// 每个数据单独写入，一起写入的话数据多了会超出journal的大小
+// 中间失败时已经写回的不再是dirty，下次只写剩下的
+func (t *TieredCache) writeBack(entries []*tieredEntry) error {
+	now := unixMs(0)
+	return t.l2do(true, func() error {
+		for _, e := range entries {
+			if e.expiredAt >= now {
+				if err := t.l2.mutate([]*op{{kind: opSet, key: e.key, val: e.val, expiredAt: e.expiredAt}}); err != nil {
+					return err
+				}
+				t.stats.WriteBacks++
+			}
+			e.dirty = false
+		}
+		return nil
+	})
+}
@@ -0,0 +1,246 @@
+package filecache_test
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Chyroc/filecache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTieredCache(t *testing.T) {
+	as := assert.New(t)
+	defer os.Remove("./test-tiered")
+
+	t.Run("write through", func(t *testing.T) {
+		os.Remove("./test-tiered")
+		l2, err := filecache.Open("./test-tiered")
+		as.Nil(err)
+		c := filecache.NewTiered(l2, filecache.WithL1MaxEntries(2))
+		defer c.Close()
+
+		as.Nil(l2.Set("k2", "v2", time.Minute))
+
+		as.Nil(c.Set("k", "v", time.Minute))
+		v, err := l2.Get("k")
+		as.Nil(err)
+		as.Equal("v", v)
+
+		v, err = c.Get("k")
+		as.Nil(err)
+		as.Equal("v", v)
+		as.Equal(uint64(1), c.Stats().L1Hits)
+
+		// L2中已经有的数据第一次从L2读
+		v, err = c.Get("k2")
+		as.Nil(err)
+		as.Equal("v2", v)
+		v, err = c.Get("k2")
+		as.Nil(err)
+		as.Equal("v2", v)
+
+		_, err = c.Get("not-exist")
+		as.Equal(filecache.NotFound, err)
+
+		stats := c.Stats()
+		as.Equal(uint64(2), stats.L1Hits)
+		as.Equal(uint64(2), stats.L1Misses)
+		as.Equal(uint64(1), stats.L2Hits)
+		as.Equal(uint64(1), stats.L2Misses)
+		as.Equal(0.5, stats.L1HitRatio())
+		as.Equal(0.5, stats.L2HitRatio())
+		as.Equal(0.75, stats.HitRatio())
+
+		// 超过2个淘汰最久没有用过的
+		as.Nil(c.Set("k3", "v3", time.Minute))
+		as.Equal(uint64(1), c.Stats().Evictions)
+		v, err = c.Get("k")
+		as.Nil(err)
+		as.Equal("v", v)
+		as.Equal(uint64(3), c.Stats().L1Misses)
+
+		ttl, err := c.TTL("k3")
+		as.Nil(err)
+		as.True(ttl > 59*time.Second)
+		as.Nil(c.Expire("k3", 10*time.Millisecond))
+		time.Sleep(20 * time.Millisecond)
+		_, err = c.Get("k3")
+		as.Equal(filecache.NotFound, err)
+
+		as.Nil(c.Del("k"))
+		_, err = c.Get("k")
+		as.Equal(filecache.NotFound, err)
+		_, err = l2.Get("k")
+		as.Equal(filecache.NotFound, err)
+	})
+
+	t.Run("invalidation", func(t *testing.T) {
+		os.Remove("./test-tiered")
+		l2, err := filecache.Open("./test-tiered")
+		as.Nil(err)
+		c := filecache.NewTiered(l2)
+		defer c.Close()
+
+		// 另一个进程打开同一个文件
+		other, err := filecache.Open("./test-tiered")
+		as.Nil(err)
+		defer other.Close()
+
+		as.Nil(c.Set("k", "v", time.Minute))
+		v, err := c.Get("k")
+		as.Nil(err)
+		as.Equal("v", v)
+
+		as.Nil(other.Set("k", "v2", time.Minute))
+		v, err = c.Get("k")
+		as.Nil(err)
+		as.Equal("v2", v)
+		as.Equal(uint64(1), c.Stats().Invalidations)
+	})
+
+	t.Run("evict hooks", func(t *testing.T) {
+		os.Remove("./test-tiered")
+		l2, err := filecache.Open("./test-tiered")
+		as.Nil(err)
+		var evicted []filecache.EvictedEvent
+		tiered := filecache.NewTiered(l2, filecache.WithL1MaxEntries(1))
+		defer tiered.Close()
+		c := filecache.Chain(tiered, filecache.WithHooks(filecache.Hooks{
+			OnEvict: func(e filecache.EvictedEvent) {
+				// 释放锁之后才调用，不会死锁
+				tiered.Stats()
+				evicted = append(evicted, e)
+			},
+		}))
+
+		as.Nil(c.Set("k1", "v1", time.Minute))
+		as.Nil(c.Set("k2", "v2", time.Minute))
+		as.Equal([]filecache.EvictedEvent{{Key: "k1", Val: "v1"}}, evicted)
+
+		// L2的FlushAll也会通知
+		evicted = nil
+		as.Nil(l2.FlushAll(false))
+		as.Len(evicted, 2)
+	})
+
+	t.Run("max bytes", func(t *testing.T) {
+		os.Remove("./test-tiered")
+		l2, err := filecache.Open("./test-tiered")
+		as.Nil(err)
+		c := filecache.NewTiered(l2, filecache.WithL1MaxBytes(12))
+		defer c.Close()
+
+		as.Nil(c.Set("k1", "1234", time.Minute))
+		as.Nil(c.Set("k2", "1234", time.Minute))
+		as.Equal(uint64(0), c.Stats().Evictions)
+		as.Nil(c.Set("k3", "1234", time.Minute))
+		as.Equal(uint64(1), c.Stats().Evictions)
+	})
+
+	t.Run("write back", func(t *testing.T) {
+		os.Remove("./test-tiered")
+		l2, err := filecache.Open("./test-tiered")
+		as.Nil(err)
+		c := filecache.NewTiered(l2, filecache.WithTieredMode(filecache.WriteBack), filecache.WithL1MaxEntries(2))
+
+		as.Equal(filecache.KeyTooShort, c.Set("", "v", time.Minute))
+
+		as.Nil(c.Set("k1", "v1", time.Minute))
+		_, err = l2.Get("k1")
+		as.Equal(filecache.NotFound, err)
+		v, err := c.Get("k1")
+		as.Nil(err)
+		as.Equal("v1", v)
+
+		// 文件被修改了，没有写回的数据不会丢
+		as.Nil(l2.Set("other", "v", time.Minute))
+		v, err = c.Get("k1")
+		as.Nil(err)
+		as.Equal("v1", v)
+
+		as.Nil(c.Flush())
+		v, err = l2.Get("k1")
+		as.Nil(err)
+		as.Equal("v1", v)
+		as.Equal(uint64(1), c.Stats().WriteBacks)
+
+		// 淘汰的时候写回
+		as.Nil(c.Set("k2", "v2", time.Minute))
+		as.Nil(c.Set("k3", "v3", time.Minute))
+		as.Nil(c.Set("k4", "v4", time.Minute))
+		v, err = l2.Get("k2")
+		as.Nil(err)
+		as.Equal("v2", v)
+
+		kvs, err := c.Range()
+		as.Nil(err)
+		as.Len(kvs, 5)
+
+		// Close的时候写回
+		as.Nil(c.Set("k5", "v5", time.Minute))
+		as.Nil(c.Close())
+
+		l2, err = filecache.Open("./test-tiered")
+		as.Nil(err)
+		defer l2.Close()
+		v, err = l2.Get("k5")
+		as.Nil(err)
+		as.Equal("v5", v)
+	})
+
+	t.Run("write back error", func(t *testing.T) {
+		os.Remove("./test-tiered")
+		l2, err := filecache.Open("./test-tiered")
+		as.Nil(err)
+		c := filecache.NewTiered(l2, filecache.WithTieredMode(filecache.WriteBack), filecache.WithL1MaxEntries(1))
+		defer c.Close()
+
+		// FlushAll之后doc有扩展头，key和value都是最长的时候放不下，写回L2会失败
+		as.Nil(l2.FlushAll(false))
+		long := strings.Repeat("k", filecache.MaxLengthKey)
+		as.Nil(c.Set(long, strings.Repeat("v", filecache.MaxLengthValue), time.Minute))
+		as.Nil(l2.Set("k2", "v2", time.Minute))
+
+		// 淘汰的时候写回失败，Get不返回这个错误
+		v, err := c.Get("k2")
+		as.Nil(err)
+		as.Equal("v2", v)
+		// 写回失败的还在L1中
+		_, err = c.Get(long)
+		as.Nil(err)
+		as.Equal(uint64(0), c.Stats().Evictions)
+		as.Equal(filecache.ValueTooLong, c.Flush())
+	})
+
+	t.Run("write back many", func(t *testing.T) {
+		os.Remove("./test-tiered")
+		l2, err := filecache.Open("./test-tiered")
+		as.Nil(err)
+		c := filecache.NewTiered(l2, filecache.WithTieredMode(filecache.WriteBack))
+
+		// 一起写回的话会超出journal的大小
+		for i := 0; i < 2000; i++ {
+			as.Nil(c.Set(fmt.Sprintf("k%d", i), "v", time.Minute))
+		}
+		as.Nil(c.Flush())
+		as.Equal(uint64(2000), c.Stats().WriteBacks)
+		as.Equal(2000, l2.Len())
+
+		for i := 0; i < 2000; i++ {
+			as.Nil(c.Set(fmt.Sprintf("k%d", i), "v2", time.Minute))
+		}
+		as.Nil(c.Close())
+		_, err = l2.Get("k0")
+		as.Equal(filecache.Closed, err)
+
+		l2, err = filecache.Open("./test-tiered")
+		as.Nil(err)
+		defer l2.Close()
+		v, err := l2.Get("k1999")
+		as.Nil(err)
+		as.Equal("v2", v)
+	})
+}
@@ -0,0 +1,152 @@
+package filecache
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+var TxnClosed = errors.New("txn closed")
+var TxnTooLarge = errors.New("txn too large")
+
+// journal里记录的是被修改之前的数据: offset(4), len(2), data
+// 事务提交前先把journal状态置为1，全部写完再置为0，打开文件时如果发现状态为1，就按照相反的顺序把旧数据写回去
+const journalRecordHeaderLength = 4 + 2
+
+type txnOp struct {
+	kind byte
+	key  string
+	val  string
+	ttl  time.Duration
+}
+
+// Txn 中的操作在Commit之前都只是记录下来，Commit的时候一起写入，要么全部成功，要么全部失败
+type Txn struct {
+	c    *CacheImpl
+	ops  []txnOp
+	done bool
+}
+
+func (r *CacheImpl) Begin() *Txn {
+	return &Txn{c: r}
+}
+
+func (t *Txn) Set(key, val string, ttl time.Duration) error {
+	if t.done {
+		return TxnClosed
+	}
+	t.ops = append(t.ops, txnOp{kind: opSet, key: key, val: val, ttl: ttl})
+	return nil
+}
+
+func (t *Txn) Expire(key string, ttl time.Duration) error {
+	if t.done {
+		return TxnClosed
+	}
+	t.ops = append(t.ops, txnOp{kind: opExpire, key: key, ttl: ttl})
+	return nil
+}
+
+func (t *Txn) Del(key string) error {
+	if t.done {
+		return TxnClosed
+	}
+	t.ops = append(t.ops, txnOp{kind: opDel, key: key})
+	return nil
+}
+
+func (t *Txn) Rollback() error {
+	if t.done {
+		return TxnClosed
+	}
+	t.done = true
+	t.ops = nil
+	return nil
+}
+
+func (t *Txn) Commit() error {
+	if t.done {
+		return TxnClosed
+	}
+	t.done = true
+
+	r := t.c
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ops := make([]*op, 0, len(t.ops))
+	for _, o := range t.ops {
+		ops = append(ops, &op{kind: o.kind, key: o.key, val: o.val, expiredAt: unixMs(o.ttl)})
+	}
+
+	return r.mutate(ops)
+}
+
+func (r *CacheImpl) journalBegin() {
+	r.putHeaderUint32(metaJournalLen, 0)
+	r.mmap[metaJournalState] = 1
+	r.journaling = true
+}
+
+func (r *CacheImpl) journalRecord(offset, length int) error {
+	used := int(r.headerUint32(metaJournalLen))
+	if used+journalRecordHeaderLength+length > journalSize {
+		return TxnTooLarge
+	}
+
+	p := journalOffset + used
+	binary.LittleEndian.PutUint32(r.mmap[p:p+4], uint32(offset))
+	binary.LittleEndian.PutUint16(r.mmap[p+4:p+6], uint16(length))
+	copy(r.mmap[p+journalRecordHeaderLength:p+journalRecordHeaderLength+length], r.mmap[offset:offset+length])
+	r.putHeaderUint32(metaJournalLen, uint32(used+journalRecordHeaderLength+length))
+
+	// 旧数据落盘之后才能修改，否则中途崩溃时可能回滚不了；meta在journal前面，一起刷
+	return r.mmap.FlushRange(0, p+journalRecordHeaderLength+length)
+}
+
+func (r *CacheImpl) journalEnd() error {
+	if err := r.mmap.Flush(); err != nil {
+		return err
+	}
+	r.journaling = false
+	r.mmap[metaJournalState] = 0
+	r.putHeaderUint32(metaJournalLen, 0)
+	return nil
+}
+
+func (r *CacheImpl) journalRollback() error {
+	used := int(r.headerUint32(metaJournalLen))
+	if used > journalSize {
+		return InvalidFileFormat
+	}
+
+	// 记录是变长的，先正序找出每条记录的位置，再倒序写回
+	var records []int
+	for p := 0; p < used; {
+		length := int(binary.LittleEndian.Uint16(r.mmap[journalOffset+p+4 : journalOffset+p+6]))
+		records = append(records, p)
+		p += journalRecordHeaderLength + length
+	}
+	for i := len(records) - 1; i >= 0; i-- {
+		p := journalOffset + records[i]
+		offset := int(binary.LittleEndian.Uint32(r.mmap[p : p+4]))
+		length := int(binary.LittleEndian.Uint16(r.mmap[p+4 : p+6]))
+		// 不会修改meta和journal，header中后面的区域（比如slab分配表）可能会修改
+		if offset < journalOffset+journalSize || offset+length > len(r.mmap) {
+			return InvalidFileFormat
+		}
+		copy(r.mmap[offset:offset+length], r.mmap[p+journalRecordHeaderLength:p+journalRecordHeaderLength+length])
+	}
+
+	// 回滚没有经过write，其他进程和索引都需要知道文件变了
+	r.putHeaderUint64(metaSeq, r.headerUint64(metaSeq)+1)
+
+	return r.journalEnd()
+}
+
+func (r *CacheImpl) recoverJournal() error {
+	if r.mmap[metaJournalState] == 0 {
+		return nil
+	}
+	return r.journalRollback()
+}
@@ -0,0 +1,117 @@
+package filecache_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Chyroc/filecache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTxn(t *testing.T) {
+	as := assert.New(t)
+	defer os.Remove("./test-txn")
+
+	os.Remove("./test-txn")
+	c, err := filecache.Open("./test-txn")
+	as.Nil(err)
+
+	t.Run("commit", func(t *testing.T) {
+		as.Nil(c.Set("k", "v", time.Minute))
+
+		txn := c.Begin()
+		as.Nil(txn.Set("a", "1", time.Minute))
+		as.Nil(txn.Set("index:1", "a", time.Minute))
+		as.Nil(txn.Del("k"))
+
+		_, err := c.Get("a")
+		as.Equal(filecache.NotFound, err)
+
+		as.Nil(txn.Commit())
+
+		v, err := c.Get("a")
+		as.Nil(err)
+		as.Equal("1", v)
+		v, err = c.Get("index:1")
+		as.Nil(err)
+		as.Equal("a", v)
+		_, err = c.Get("k")
+		as.Equal(filecache.NotFound, err)
+
+		as.Equal(filecache.TxnClosed, txn.Commit())
+		as.Equal(filecache.TxnClosed, txn.Set("b", "2", time.Minute))
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		txn := c.Begin()
+		as.Nil(txn.Set("b", "2", time.Minute))
+		as.Nil(txn.Rollback())
+		as.Equal(filecache.TxnClosed, txn.Commit())
+
+		_, err := c.Get("b")
+		as.Equal(filecache.NotFound, err)
+	})
+
+	t.Run("all or nothing", func(t *testing.T) {
+		txn := c.Begin()
+		as.Nil(txn.Set("a", "2", time.Minute))
+		as.Nil(txn.Expire("index:1", time.Hour))
+		as.Nil(txn.Set("c", "3", time.Minute))
+		as.Nil(txn.Expire("not-exist", time.Minute))
+		as.Equal(filecache.NotFound, txn.Commit())
+
+		v, err := c.Get("a")
+		as.Nil(err)
+		as.Equal("1", v)
+		ttl, err := c.TTL("index:1")
+		as.Nil(err)
+		as.True(ttl <= time.Minute)
+		_, err = c.Get("c")
+		as.Equal(filecache.NotFound, err)
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		c, err := filecache.Open("./test-txn")
+		as.Nil(err)
+
+		v, err := c.Get("a")
+		as.Nil(err)
+		as.Equal("1", v)
+		as.Nil(c.Close())
+	})
+
+	t.Run("crash", func(t *testing.T) {
+		as.Nil(c.Set("crash", "old", time.Minute))
+		as.Nil(c.Close())
+
+		// 模拟事务写了一半的时候崩溃：journal中是旧数据，数据区已经改了，状态还是1
+		data, err := ioutil.ReadFile("./test-txn")
+		as.Nil(err)
+		offset := 1048576 + bytes.Index(data[1048576:], []byte("crashold")) - 12
+		record := make([]byte, 6+1280)
+		binary.LittleEndian.PutUint32(record, uint32(offset))
+		binary.LittleEndian.PutUint16(record[4:], 1280)
+		copy(record[6:], data[offset:offset+1280])
+		copy(data[4096:], record)
+		binary.LittleEndian.PutUint32(data[16:], uint32(len(record)))
+		data[12] = 1
+		copy(data[offset+12+5:], "new")
+		as.Nil(ioutil.WriteFile("./test-txn", data, 0600))
+
+		c, err := filecache.Open("./test-txn")
+		as.Nil(err)
+		v, err := c.Get("crash")
+		as.Nil(err)
+		as.Equal("old", v)
+		as.Nil(c.Close())
+
+		data, err = ioutil.ReadFile("./test-txn")
+		as.Nil(err)
+		as.Equal(byte(0), data[12])
+		as.Equal(uint32(0), binary.LittleEndian.Uint32(data[16:]))
+	})
+}
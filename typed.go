@@ -0,0 +1,167 @@
+//go:build go1.18
+// +build go1.18
+
+package filecache
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// Codec 把TypedCache中的值转换成字符串保存
+// msgpack、protobuf等可以实现这个接口，生成的类型实现了encoding.BinaryMarshaler的可以直接用BinaryCodec
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	JSONCodec   Codec = jsonCodec{}
+	GobCodec    Codec = gobCodec{}
+	BinaryCodec Codec = binaryCodec{}
+)
+
+// DecodeError 读到了值，但是不能解码，和NotFound区分开
+type DecodeError struct {
+	Key string
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("decode %q: %s", e.Key, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// TypedCache 在Cache之上按codec编解码，Get不到时返回NotFound，解码失败返回*DecodeError
+type TypedCache[T any] struct {
+	cache Cache
+	codec Codec
+}
+
+type TypedKV[T any] struct {
+	Key string
+	Val T
+	TTL time.Duration
+}
+
+func NewTyped[T any](cache Cache, codec Codec) *TypedCache[T] {
+	return &TypedCache[T]{cache: cache, codec: codec}
+}
+
+func (t *TypedCache[T]) Get(key string) (T, error) {
+	var v T
+	s, err := t.cache.Get(key)
+	if err != nil {
+		return v, err
+	}
+	if err := t.codec.Unmarshal([]byte(s), &v); err != nil {
+		return v, &DecodeError{Key: key, Err: err}
+	}
+	return v, nil
+}
+
+func (t *TypedCache[T]) Set(key string, val T, ttl time.Duration) error {
+	data, err := t.codec.Marshal(val)
+	if err != nil {
+		return err
+	}
+	return t.cache.Set(key, string(data), ttl)
+}
+
+func (t *TypedCache[T]) TTL(key string) (time.Duration, error) {
+	return t.cache.TTL(key)
+}
+
+func (t *TypedCache[T]) Expire(key string, ttl time.Duration) error {
+	return t.cache.Expire(key, ttl)
+}
+
+func (t *TypedCache[T]) Del(key string) error {
+	return t.cache.Del(key)
+}
+
+// Range 有值解码失败时返回*DecodeError
+func (t *TypedCache[T]) Range() ([]*TypedKV[T], error) {
+	kvs, err := t.cache.Range()
+	if err != nil {
+		return nil, err
+	}
+
+	typed := make([]*TypedKV[T], 0, len(kvs))
+	for _, kv := range kvs {
+		tkv := &TypedKV[T]{Key: kv.Key, TTL: kv.TTL}
+		if err := t.codec.Unmarshal([]byte(kv.Val), &tkv.Val); err != nil {
+			return nil, &DecodeError{Key: kv.Key, Err: err}
+		}
+		typed = append(typed, tkv)
+	}
+	return typed, nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// 支持值和指针类型，方法定义在指针上也可以
+type binaryCodec struct{}
+
+func (binaryCodec) Marshal(v interface{}) ([]byte, error) {
+	if m, ok := v.(encoding.BinaryMarshaler); ok {
+		return m.MarshalBinary()
+	} else if v == nil {
+		return nil, fmt.Errorf("cannot marshal nil")
+	}
+	p := reflect.New(reflect.TypeOf(v))
+	p.Elem().Set(reflect.ValueOf(v))
+	if m, ok := p.Interface().(encoding.BinaryMarshaler); ok {
+		return m.MarshalBinary()
+	}
+	return nil, fmt.Errorf("%T does not implement encoding.BinaryMarshaler", v)
+}
+
+func (binaryCodec) Unmarshal(data []byte, v interface{}) error {
+	if u, ok := v.(encoding.BinaryUnmarshaler); ok {
+		return u.UnmarshalBinary(data)
+	}
+	// v是**X，需要先分配X
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr && rv.Elem().Kind() == reflect.Ptr {
+		p := reflect.New(rv.Elem().Type().Elem())
+		if u, ok := p.Interface().(encoding.BinaryUnmarshaler); ok {
+			if err := u.UnmarshalBinary(data); err != nil {
+				return err
+			}
+			rv.Elem().Set(p)
+			return nil
+		}
+	}
+	return fmt.Errorf("%T does not implement encoding.BinaryUnmarshaler", v)
+}
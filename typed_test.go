@@ -0,0 +1,88 @@
+//go:build go1.18
+// +build go1.18
+
+package filecache_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Chyroc/filecache"
+	"github.com/stretchr/testify/assert"
+)
+
+type user struct {
+	Name string
+	Age  int
+}
+
+type point struct {
+	X, Y int32
+}
+
+func (p *point) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint32(buf, uint32(p.X))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(p.Y))
+	return buf, nil
+}
+
+func (p *point) UnmarshalBinary(data []byte) error {
+	if len(data) != 8 {
+		return errors.New("invalid point")
+	}
+	p.X = int32(binary.LittleEndian.Uint32(data))
+	p.Y = int32(binary.LittleEndian.Uint32(data[4:]))
+	return nil
+}
+
+func TestTyped(t *testing.T) {
+	as := assert.New(t)
+	defer os.Remove("./test-typed")
+	os.Remove("./test-typed")
+
+	c := filecache.New("./test-typed")
+
+	for _, codec := range []filecache.Codec{filecache.JSONCodec, filecache.GobCodec} {
+		users := filecache.NewTyped[user](c, codec)
+		as.Nil(users.Set("u", user{Name: "a", Age: 1}, time.Minute))
+		u, err := users.Get("u")
+		as.Nil(err)
+		as.Equal(user{Name: "a", Age: 1}, u)
+
+		_, err = users.Get("not-exist")
+		as.Equal(filecache.NotFound, err)
+	}
+
+	points := filecache.NewTyped[point](c, filecache.BinaryCodec)
+	as.Nil(points.Set("p", point{X: 1, Y: -2}, time.Minute))
+	p, err := points.Get("p")
+	as.Nil(err)
+	as.Equal(point{X: 1, Y: -2}, p)
+
+	pointers := filecache.NewTyped[*point](c, filecache.BinaryCodec)
+	pp, err := pointers.Get("p")
+	as.Nil(err)
+	as.Equal(&point{X: 1, Y: -2}, pp)
+
+	// 解码失败和NotFound区分开
+	as.Nil(c.Set("bad", "not json", time.Minute))
+	users := filecache.NewTyped[user](c, filecache.JSONCodec)
+	_, err = users.Get("bad")
+	var decodeErr *filecache.DecodeError
+	as.True(errors.As(err, &decodeErr))
+	as.Equal("bad", decodeErr.Key)
+	_, err = users.Range()
+	as.True(errors.As(err, &decodeErr))
+
+	as.Nil(c.Del("bad"))
+	as.Nil(c.Del("p"))
+	as.Nil(users.Set("u", user{Name: "a", Age: 1}, time.Minute))
+	kvs, err := users.Range()
+	as.Nil(err)
+	as.Len(kvs, 1)
+	as.Equal("u", kvs[0].Key)
+}
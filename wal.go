@@ -0,0 +1,344 @@
+package filecache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+var invalidWALRecord = errors.New("invalid wal record")
+
+// 文件在记录的中间结束了，只可能是最后一条记录没有写完
+var tornWALRecord = errors.New("torn wal record")
+
+type SyncPolicy int
+
+const (
+	SyncAlways      SyncPolicy = iota // 每次写完wal都fsync
+	SyncEverySecond                   // 距离上次fsync超过1s才fsync
+	SyncNever                         // 交给操作系统
+)
+
+// wal的每条记录是 len(4), crc32(4), payload，开启了加密的时候payload是加密的
+// payload是一组op: count(uvarint), [kind(1), key_len(uvarint), key, val_len(uvarint), val, expiredAt(varint), grace(varint)?, ns(1)?]...
+// 只有kind中有opGrace、opNamespace时才有grace、ns，之前版本写的记录可以直接读
+// 一个事务是一条记录，回放的时候也是整体成功或者整体失败
+const walRecordHeaderLength = 4 + 4
+
+// kind的高位表示后面有grace、ns
+const (
+	opGrace     = 0x80
+	opNamespace = 0x40
+)
+const maxRecordLength = 16 << 20
+
+// 多个进程共用一个wal，写wal、修改mmap、checkpoint都要持有wal文件上的锁（flock）
+// 这样wal中的记录和mmap中的修改顺序一致，checkpoint时其他进程的记录也都已经写到mmap里了
+type wal struct {
+	mu       sync.Mutex // 进程内同时只有一个goroutine持有文件锁，Snapshot只持有r.mu的读锁
+	file     *os.File
+	policy   SyncPolicy
+	size     int64 // 持有锁时最后一次看到的文件大小
+	syncedAt time.Time
+	enc      *encryption
+}
+
+// 锁住wal文件，文件锁是进程级的，进程内还要用w.mu互斥
+func (w *wal) lock() error {
+	w.mu.Lock()
+	if err := w.flock(); err != nil {
+		w.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (w *wal) unlock() error {
+	defer w.mu.Unlock()
+	return w.funlock()
+}
+
+func (r *CacheImpl) openWAL() error {
+	file, err := os.OpenFile(r.filepath+".wal", os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := &wal{file: file, policy: r.options.walSync, enc: r.encryption}
+	if err := w.lock(); err != nil {
+		file.Close()
+		return err
+	}
+	defer w.unlock()
+
+	if err := r.replayWAL(w); err != nil {
+		file.Close()
+		return err
+	}
+
+	r.wal = w
+	return r.checkpoint()
+}
+
+// 回放出错时直接返回，不会checkpoint，wal中的记录会保留下来
+func (r *CacheImpl) replayWAL(w *wal) error {
+	br := bufio.NewReader(w.file)
+	for {
+		payload, err := readPayload(br)
+		if err == io.EOF || err == tornWALRecord {
+			// 读完了，或者最后一条记录没有写完
+			return nil
+		} else if err == invalidWALRecord {
+			// 校验失败的记录在文件末尾的话也是没有写完，后面还有数据说明wal坏了
+			if _, err := br.Peek(1); err == io.EOF {
+				return nil
+			}
+			return InvalidFileFormat
+		} else if err != nil {
+			return err
+		}
+		if w.enc != nil {
+			if payload, err = w.enc.open(payload, nil); err != nil {
+				return err
+			}
+		}
+		ops, err := decodeOps(payload)
+		if err != nil {
+			return InvalidFileFormat
+		}
+
+		// 写wal之后修改失败的记录已经被截掉了，NotFound只可能是因为mmap已经包含了后面的修改（比如key已经被删除了）
+		if err := r.applyAll(ops); err != nil && err != NotFound {
+			return err
+		}
+	}
+}
+
+// 需要持有锁，返回写入之前wal的大小
+func (w *wal) append(ops []*op) (int64, error) {
+	payload := encodeOps(ops)
+	if w.enc != nil {
+		var err error
+		if payload, err = w.enc.seal(payload, nil); err != nil {
+			return 0, err
+		}
+	}
+	buf := frameRecord(payload)
+
+	// 其他进程可能写过或者checkpoint过
+	fi, err := w.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := fi.Size()
+	if _, err := w.file.Write(buf); err != nil {
+		return 0, err
+	}
+	w.size = size + int64(len(buf))
+
+	switch w.policy {
+	case SyncAlways:
+		return size, w.sync()
+	case SyncEverySecond:
+		if time.Since(w.syncedAt) >= time.Second {
+			return size, w.sync()
+		}
+	}
+	return size, nil
+}
+
+func (w *wal) sync() error {
+	w.syncedAt = time.Now()
+	return w.file.Sync()
+}
+
+// 需要持有锁
+func (w *wal) truncate(size int64) error {
+	if err := w.file.Truncate(size); err != nil {
+		return err
+	}
+	w.size = size
+	return nil
+}
+
+func encodeRecord(ops []*op) []byte {
+	return frameRecord(encodeOps(ops))
+}
+
+func frameRecord(payload []byte) []byte {
+	buf := make([]byte, walRecordHeaderLength+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[walRecordHeaderLength:], payload)
+	return buf
+}
+
+// 读取一条完整的记录，没有数据了返回io.EOF
+func readRecord(r io.Reader) ([]*op, error) {
+	payload, err := readPayload(r)
+	if err == tornWALRecord {
+		return nil, invalidWALRecord
+	} else if err != nil {
+		return nil, err
+	}
+	return decodeOps(payload)
+}
+
+func readPayload(r io.Reader) ([]byte, error) {
+	header := make([]byte, walRecordHeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, tornWALRecord
+		}
+		return nil, err
+	}
+
+	length := binary.LittleEndian.Uint32(header[0:4])
+	if length > maxRecordLength {
+		return nil, invalidWALRecord
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, tornWALRecord
+	} else if err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:8]) {
+		return nil, invalidWALRecord
+	}
+
+	return payload, nil
+}
+
+func encodeOps(ops []*op) []byte {
+	buf := make([]byte, 0, 64)
+	tmp := make([]byte, binary.MaxVarintLen64)
+
+	buf = append(buf, tmp[:binary.PutUvarint(tmp, uint64(len(ops)))]...)
+	for _, o := range ops {
+		kind := o.kind
+		if o.grace > 0 {
+			kind |= opGrace
+		}
+		if o.ns > 0 {
+			kind |= opNamespace
+		}
+		buf = append(buf, kind)
+		buf = append(buf, tmp[:binary.PutUvarint(tmp, uint64(len(o.key)))]...)
+		buf = append(buf, o.key...)
+		buf = append(buf, tmp[:binary.PutUvarint(tmp, uint64(len(o.val)))]...)
+		buf = append(buf, o.val...)
+		buf = append(buf, tmp[:binary.PutVarint(tmp, o.expiredAt)]...)
+		if o.grace > 0 {
+			buf = append(buf, tmp[:binary.PutVarint(tmp, o.grace)]...)
+		}
+		if o.ns > 0 {
+			buf = append(buf, o.ns)
+		}
+	}
+	return buf
+}
+
+func decodeOps(buf []byte) ([]*op, error) {
+	count, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, invalidWALRecord
+	}
+	buf = buf[n:]
+
+	var ops []*op
+	for i := 0; i < int(count); i++ {
+		if len(buf) == 0 {
+			return nil, invalidWALRecord
+		}
+		o := &op{kind: buf[0] &^ (opGrace | opNamespace)}
+		hasGrace, hasNamespace := buf[0]&opGrace != 0, buf[0]&opNamespace != 0
+		buf = buf[1:]
+
+		keyLen, n := binary.Uvarint(buf)
+		if n <= 0 || len(buf[n:]) < int(keyLen) {
+			return nil, invalidWALRecord
+		}
+		o.key = string(buf[n : n+int(keyLen)])
+		buf = buf[n+int(keyLen):]
+
+		valLen, n := binary.Uvarint(buf)
+		if n <= 0 || len(buf[n:]) < int(valLen) {
+			return nil, invalidWALRecord
+		}
+		o.val = string(buf[n : n+int(valLen)])
+		buf = buf[n+int(valLen):]
+
+		o.expiredAt, n = binary.Varint(buf)
+		if n <= 0 {
+			return nil, invalidWALRecord
+		}
+		buf = buf[n:]
+
+		if hasGrace {
+			o.grace, n = binary.Varint(buf)
+			if n <= 0 || o.grace <= 0 {
+				return nil, invalidWALRecord
+			}
+			buf = buf[n:]
+		}
+		if hasNamespace {
+			if len(buf) == 0 || buf[0] == 0 {
+				return nil, invalidWALRecord
+			}
+			o.ns, buf = buf[0], buf[1:]
+		}
+
+		ops = append(ops, o)
+	}
+
+	return ops, nil
+}
+
+// 需要持有wal的锁
+func (r *CacheImpl) maybeCheckpoint() error {
+	if r.wal == nil || r.wal.size < r.options.walCheckpointSize {
+		return nil
+	}
+	return r.checkpoint()
+}
+
+// 先把mmap刷到磁盘上，之后wal里的记录就不需要了，需要持有wal的锁
+func (r *CacheImpl) checkpoint() error {
+	if r.wal == nil {
+		return nil
+	}
+	if err := r.mmap.Flush(); err != nil {
+		return err
+	}
+	if err := r.wal.truncate(0); err != nil {
+		return err
+	}
+	return r.wal.sync()
+}
+
+func (r *CacheImpl) Checkpoint() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return r.err
+	}
+	return r.lockedCheckpoint()
+}
+
+func (r *CacheImpl) lockedCheckpoint() error {
+	if r.wal == nil {
+		return nil
+	}
+	if err := r.wal.lock(); err != nil {
+		return err
+	}
+	defer r.wal.unlock()
+	return r.checkpoint()
+}
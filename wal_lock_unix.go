@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package filecache
+
+import (
+	"syscall"
+)
+
+func (w *wal) flock() error {
+	return syscall.Flock(int(w.file.Fd()), syscall.LOCK_EX)
+}
+
+func (w *wal) funlock() error {
+	return syscall.Flock(int(w.file.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,35 @@
+//go:build windows
+// +build windows
+
+package filecache
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32         = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = kernel32.NewProc("LockFileEx")
+	procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+)
+
+const lockfileExclusiveLock = 0x2
+
+func (w *wal) flock() error {
+	var ol syscall.Overlapped
+	r, _, err := procLockFileEx.Call(w.file.Fd(), lockfileExclusiveLock, 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+func (w *wal) funlock() error {
+	var ol syscall.Overlapped
+	r, _, err := procUnlockFileEx.Call(w.file.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
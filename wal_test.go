@@ -0,0 +1,173 @@
+package filecache_test
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Chyroc/filecache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWAL(t *testing.T) {
+	as := assert.New(t)
+	defer os.Remove("./test-wal")
+	defer os.Remove("./test-wal.wal")
+
+	os.Remove("./test-wal")
+	os.Remove("./test-wal.wal")
+
+	t.Run("append and checkpoint", func(t *testing.T) {
+		c, err := filecache.Open("./test-wal", filecache.WithWAL(filecache.SyncAlways))
+		as.Nil(err)
+
+		as.Nil(c.Set("k", "v", time.Minute))
+		fi, err := os.Stat("./test-wal.wal")
+		as.Nil(err)
+		as.True(fi.Size() > 0)
+
+		// 失败的修改不会留在wal中
+		as.Equal(filecache.NotFound, c.Expire("not-exist", time.Minute))
+		fi2, err := os.Stat("./test-wal.wal")
+		as.Nil(err)
+		as.Equal(fi.Size(), fi2.Size())
+
+		as.Nil(c.Checkpoint())
+		fi, err = os.Stat("./test-wal.wal")
+		as.Nil(err)
+		as.Equal(int64(0), fi.Size())
+
+		as.Nil(c.Close())
+		as.Equal(filecache.Closed, c.Set("k", "v", time.Minute))
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		c, err := filecache.Open("./test-wal", filecache.WithWAL(filecache.SyncAlways))
+		as.Nil(err)
+
+		txn := c.Begin()
+		as.Nil(txn.Set("a", "1", time.Minute))
+		as.Nil(txn.Set("b", "2", time.Minute))
+		as.Nil(txn.Commit())
+		as.Nil(c.Del("k"))
+
+		log, err := ioutil.ReadFile("./test-wal.wal")
+		as.Nil(err)
+
+		// 模拟wal写完之后mmap没有落盘的情况
+		as.Nil(c.Del("a"))
+		as.Nil(c.Del("b"))
+		as.Nil(c.Set("k", "v", time.Minute))
+		as.Nil(c.Close())
+
+		// 最后一条记录没有写完
+		as.Nil(ioutil.WriteFile("./test-wal.wal", append(log, 1, 2, 3), 0600))
+
+		c, err = filecache.Open("./test-wal", filecache.WithWAL(filecache.SyncAlways))
+		as.Nil(err)
+
+		v, err := c.Get("a")
+		as.Nil(err)
+		as.Equal("1", v)
+		v, err = c.Get("b")
+		as.Nil(err)
+		as.Equal("2", v)
+		_, err = c.Get("k")
+		as.Equal(filecache.NotFound, err)
+
+		fi, err := os.Stat("./test-wal.wal")
+		as.Nil(err)
+		as.Equal(int64(0), fi.Size())
+		as.Nil(c.Close())
+	})
+
+	t.Run("multi process", func(t *testing.T) {
+		c, err := filecache.Open("./test-wal", filecache.WithWAL(filecache.SyncAlways))
+		as.Nil(err)
+		defer c.Close()
+		other, err := filecache.Open("./test-wal", filecache.WithWAL(filecache.SyncAlways))
+		as.Nil(err)
+		defer other.Close()
+
+		as.Nil(c.Set("k1", "v", time.Minute))
+		fi, err := os.Stat("./test-wal.wal")
+		as.Nil(err)
+		size := fi.Size()
+
+		// 都追加在文件末尾，不会覆盖其他进程的记录
+		as.Nil(other.Set("k2", "v", time.Minute))
+		as.Nil(c.Set("k3", "v", time.Minute))
+		fi, err = os.Stat("./test-wal.wal")
+		as.Nil(err)
+		as.Equal(3*size, fi.Size())
+
+		// 其他进程checkpoint之后从头开始写
+		as.Nil(other.Checkpoint())
+		as.Nil(c.Set("k4", "v", time.Minute))
+		fi, err = os.Stat("./test-wal.wal")
+		as.Nil(err)
+		as.Equal(size, fi.Size())
+	})
+
+	t.Run("replay error", func(t *testing.T) {
+		// kind不对的记录，回放失败时Open返回错误，wal保留下来
+		payload := []byte{1, 9, 1, 'k', 1, 'v', 0}
+		record := make([]byte, 8, 8+len(payload))
+		binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+		binary.LittleEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+		record = append(record, payload...)
+		as.Nil(ioutil.WriteFile("./test-wal.wal", record, 0600))
+
+		_, err := filecache.Open("./test-wal", filecache.WithWAL(filecache.SyncAlways))
+		as.Equal(filecache.InvalidFileFormat, err)
+		log, err := ioutil.ReadFile("./test-wal.wal")
+		as.Nil(err)
+		as.Equal(record, log)
+	})
+	t.Run("corrupted record", func(t *testing.T) {
+		os.Remove("./test-wal.wal")
+		c, err := filecache.Open("./test-wal", filecache.WithWAL(filecache.SyncAlways))
+		as.Nil(err)
+		as.Nil(c.Set("c1", "v", time.Minute))
+		as.Nil(c.Set("c2", "v", time.Minute))
+		as.Nil(c.Set("c3", "v", time.Minute))
+		log, err := ioutil.ReadFile("./test-wal.wal")
+		as.Nil(err)
+		size := len(log) / 3
+		as.Nil(c.Del("c1"))
+		as.Nil(c.Del("c2"))
+		as.Nil(c.Del("c3"))
+		as.Nil(c.Close())
+
+		// 中间的记录坏了，后面的记录不能跳过，Open返回错误，wal保留下来
+		corrupted := append([]byte(nil), log...)
+		corrupted[size+walHeaderLength] ^= 0xff
+		as.Nil(ioutil.WriteFile("./test-wal.wal", corrupted, 0600))
+		_, err = filecache.Open("./test-wal", filecache.WithWAL(filecache.SyncAlways))
+		as.Equal(filecache.InvalidFileFormat, err)
+		data, err := ioutil.ReadFile("./test-wal.wal")
+		as.Nil(err)
+		as.Equal(corrupted, data)
+
+		// 最后一条记录校验失败，当作没有写完
+		corrupted = append([]byte(nil), log...)
+		corrupted[2*size+walHeaderLength] ^= 0xff
+		as.Nil(ioutil.WriteFile("./test-wal.wal", corrupted, 0600))
+		c, err = filecache.Open("./test-wal", filecache.WithWAL(filecache.SyncAlways))
+		as.Nil(err)
+		defer c.Close()
+		_, err = c.Get("c2")
+		as.Nil(err)
+		_, err = c.Get("c3")
+		as.Equal(filecache.NotFound, err)
+		fi, err := os.Stat("./test-wal.wal")
+		as.Nil(err)
+		as.Equal(int64(0), fi.Size())
+	})
+}
+
+// len(4) + crc32(4)
+const walHeaderLength = 8
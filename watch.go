@@ -0,0 +1,203 @@
+package filecache
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+)
+
+// hash了key的文件中没有原来的key，不记录修改
+var WatchNotSupported = errors.New("watch is not supported when keys are hashed")
+
+type EventType int
+
+const (
+	EventSet    EventType = iota + 1
+	EventDel              // Del删除了数据，key不存在时没有事件
+	EventExpire           // Expire修改了过期时间
+	EventEvict            // FlushAll或者Bucket.Flush，Key为空，Bucket为空时是FlushAll
+	EventLost             // 读得太慢，环形缓冲区中的记录被覆盖了，中间的事件丢失了，需要重新读取所有数据
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventSet:
+		return "set"
+	case EventDel:
+		return "del"
+	case EventExpire:
+		return "expire"
+	case EventEvict:
+		return "evict"
+	case EventLost:
+		return "lost"
+	}
+	return "unknown"
+}
+
+type Event struct {
+	Type   EventType
+	Key    string
+	Bucket string // 默认的namespace为空
+	Seq    uint64 // 修改的序号，所有进程共用，EventLost的Seq是丢失之后的第一个
+}
+
+// 修改记录是header中的一个环形缓冲区: head(8) + changeSlots个记录，head是写入过的记录的数量
+// 每个记录是 seq(8), type(1), ns(1), key_len(1), key，第seq个记录(从1开始)在(seq-1)%changeSlots的位置
+const changeOffset = bucketOffset + bucketEntrySize*maxBuckets
+const changeSlots = 1024
+const changeEntrySize = 256
+
+func changeEntry(seq uint64) int {
+	return changeOffset + 8 + int((seq-1)%changeSlots)*changeEntrySize
+}
+
+type watchOptions struct {
+	interval time.Duration
+	buffer   int
+}
+
+type WatchOption func(*watchOptions)
+
+// WithWatchInterval 多久检查一次修改记录，默认100ms
+func WithWatchInterval(interval time.Duration) WatchOption {
+	return func(o *watchOptions) {
+		o.interval = interval
+	}
+}
+
+// WithWatchBuffer channel的长度，默认64，channel满了的时候不再读取，太慢会收到EventLost
+func WithWatchBuffer(n int) WatchOption {
+	return func(o *watchOptions) {
+		o.buffer = n
+	}
+}
+
+// 在修改数据的地方调用，经过write，事务回滚的时候一起回滚
+func (r *CacheImpl) logChange(typ EventType, ns int, key string) error {
+	if r.encryption != nil && r.encryption.hashKeys {
+		return nil
+	}
+
+	seq := r.headerUint64(changeOffset) + 1
+	buf := make([]byte, 11+len(key))
+	binary.LittleEndian.PutUint64(buf, seq)
+	buf[8] = byte(typ)
+	buf[9] = byte(ns)
+	buf[10] = byte(len(key))
+	copy(buf[11:], key)
+	if err := r.write(changeEntry(seq), buf); err != nil {
+		return err
+	}
+	// 记录写完了才更新head，其他进程读到head的时候记录是完整的
+	head := make([]byte, 8)
+	binary.LittleEndian.PutUint64(head, seq)
+	return r.write(changeOffset, head)
+}
+
+// Watch 返回之后所有进程对key以prefix开头的数据的修改，EventEvict和EventLost不管prefix都会收到
+// 通过定期读取header中的修改记录实现，有一定的延迟。ctx结束或者cache关闭之后channel会关闭
+// 只能看到记录了修改的版本写入的数据，GetStale、过期清理等不会产生事件
+func (r *CacheImpl) Watch(ctx context.Context, prefix string, opts ...WatchOption) (<-chan Event, error) {
+	o := watchOptions{interval: 100 * time.Millisecond, buffer: 64}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.err != nil {
+		return nil, r.err
+	} else if r.encryption != nil && r.encryption.hashKeys {
+		return nil, WatchNotSupported
+	}
+
+	ch := make(chan Event, o.buffer)
+	go r.watch(ctx, prefix, r.headerUint64(changeOffset), ch, &o)
+	return ch, nil
+}
+
+func (r *CacheImpl) watch(ctx context.Context, prefix string, last uint64, ch chan Event, o *watchOptions) {
+	defer close(ch)
+
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		events, next, err := r.readChanges(last, prefix)
+		if err != nil {
+			return
+		}
+		last = next
+		for _, e := range events {
+			select {
+			case ch <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// 读取last之后的修改记录，返回读到的最后一个seq
+func (r *CacheImpl) readChanges(last uint64, prefix string) ([]Event, uint64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.err != nil {
+		return nil, last, r.err
+	}
+
+	var events []Event
+	head := r.headerUint64(changeOffset)
+	if head < last {
+		// 文件被重建过
+		last = head
+	}
+	if head-last > changeSlots {
+		last = head - changeSlots
+		events = append(events, Event{Type: EventLost, Seq: last + 1})
+	}
+	for seq := last + 1; seq <= head; seq++ {
+		e, ok := r.readChange(seq)
+		if !ok {
+			// 读的时候被其他进程覆盖了
+			events = append(events, Event{Type: EventLost, Seq: seq})
+			continue
+		}
+		if e.Type == EventEvict || strings.HasPrefix(e.Key, prefix) {
+			events = append(events, e)
+		}
+	}
+	return events, head, nil
+}
+
+// 读取前后的seq不一致说明记录被覆盖了
+func (r *CacheImpl) readChange(seq uint64) (Event, bool) {
+	offset := changeEntry(seq)
+	if binary.LittleEndian.Uint64(r.mmap[offset:offset+8]) != seq {
+		return Event{}, false
+	}
+	typ, ns, keyLen := r.mmap[offset+8], int(r.mmap[offset+9]), int(r.mmap[offset+10])
+	if keyLen > MaxLengthKey {
+		return Event{}, false
+	}
+	e := Event{
+		Type: EventType(typ),
+		Key:  string(r.mmap[offset+11 : offset+11+keyLen]),
+		Seq:  seq,
+	}
+	if ns > 0 {
+		e.Bucket = r.bucketName(ns)
+	}
+	if binary.LittleEndian.Uint64(r.mmap[offset:offset+8]) != seq {
+		return Event{}, false
+	}
+	return e, true
+}
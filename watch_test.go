@@ -0,0 +1,119 @@
+package filecache_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Chyroc/filecache"
+	"github.com/stretchr/testify/assert"
+)
+
+// 读取n个事件，超时返回已经读到的
+func readEvents(ch <-chan filecache.Event, n int) []filecache.Event {
+	var events []filecache.Event
+	timeout := time.After(5 * time.Second)
+	for len(events) < n {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return events
+			}
+			events = append(events, e)
+		case <-timeout:
+			return events
+		}
+	}
+	return events
+}
+
+func TestWatch(t *testing.T) {
+	as := assert.New(t)
+	defer os.Remove("./test-watch")
+	os.Remove("./test-watch")
+
+	c, err := filecache.Open("./test-watch")
+	as.Nil(err)
+	defer c.Close()
+	as.Nil(c.Set("cfg:before", "v", time.Minute))
+
+	// 另一个进程
+	other, err := filecache.Open("./test-watch")
+	as.Nil(err)
+	defer other.Close()
+
+	t.Run("events", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ch, err := other.Watch(ctx, "cfg:", filecache.WithWatchInterval(10*time.Millisecond))
+		as.Nil(err)
+
+		as.Nil(c.Set("cfg:a", "v", time.Minute))
+		as.Nil(c.Set("other", "v", time.Minute))
+		as.Nil(c.Expire("cfg:a", time.Hour))
+		as.Nil(c.Del("cfg:a"))
+		as.Nil(c.Del("cfg:not-exist"))
+		b, err := c.Bucket("bk")
+		as.Nil(err)
+		as.Nil(b.Set("cfg:b", "v", time.Minute))
+		as.Nil(b.Flush())
+		as.Nil(c.FlushAll(false))
+
+		events := readEvents(ch, 6)
+		as.Len(events, 6)
+		for i, e := range events {
+			e.Seq = 0
+			events[i] = e
+		}
+		as.Equal([]filecache.Event{
+			{Type: filecache.EventSet, Key: "cfg:a"},
+			{Type: filecache.EventExpire, Key: "cfg:a"},
+			{Type: filecache.EventDel, Key: "cfg:a"},
+			{Type: filecache.EventSet, Key: "cfg:b", Bucket: "bk"},
+			{Type: filecache.EventEvict, Bucket: "bk"},
+			{Type: filecache.EventEvict},
+		}, events)
+
+		cancel()
+		as.Len(readEvents(ch, 1), 0)
+	})
+
+	t.Run("lost", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ch, err := other.Watch(ctx, "", filecache.WithWatchInterval(time.Second))
+		as.Nil(err)
+
+		for i := 0; i < 1100; i++ {
+			as.Nil(c.Set("k", "v", time.Minute))
+		}
+		events := readEvents(ch, 1025)
+		as.Len(events, 1025)
+		as.Equal(filecache.EventLost, events[0].Type)
+		as.Equal(events[0].Seq, events[1].Seq)
+		as.Equal(filecache.EventSet, events[1024].Type)
+	})
+
+	t.Run("close", func(t *testing.T) {
+		ch, err := c.Watch(context.Background(), "", filecache.WithWatchInterval(10*time.Millisecond))
+		as.Nil(err)
+		as.Nil(c.Close())
+		as.Len(readEvents(ch, 1), 0)
+		_, err = c.Watch(context.Background(), "")
+		as.Equal(filecache.Closed, err)
+	})
+}
+
+func TestWatchHashedKeys(t *testing.T) {
+	as := assert.New(t)
+	defer os.Remove("./test-watch-hashed")
+	os.Remove("./test-watch-hashed")
+
+	c, err := filecache.Open("./test-watch-hashed", filecache.WithEncryption([]byte("0123456789abcdef"), true))
+	as.Nil(err)
+	defer c.Close()
+
+	_, err = c.Watch(context.Background(), "")
+	as.Equal(filecache.WatchNotSupported, err)
+}